@@ -0,0 +1,122 @@
+package downloader
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	AdaptiveInitialConnections = 2
+	// AdaptiveInterval is the seconds between adjustments
+	AdaptiveInterval = 2
+	// AdaptiveGrowth is the rise of throughput to keep a new connection
+	AdaptiveGrowth = 1.1
+	// AdaptiveCollapse is the fraction of best per connection throughput to shed a connection
+	AdaptiveCollapse = 0.3
+	// AdaptiveHold is the intervals to wait before adding connections after pushback
+	AdaptiveHold = 3
+)
+
+// adaptive tunes the connection count, it adds one connection at a time while the aggregate throughput rises,
+// and sheds connections on server pushback or collapsed per connection throughput.
+type adaptive struct {
+	limit   int
+	max     int
+	bytes   int64
+	ticks   int
+	best    float64
+	bestPer float64
+	probing bool
+	hold    int
+}
+
+func newAdaptive(max int) *adaptive {
+	limit := AdaptiveInitialConnections
+	if limit > max {
+		limit = max
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return &adaptive{limit: limit, max: max}
+}
+
+// Limit .
+func (a *adaptive) Limit() int {
+	return a.limit
+}
+
+func (a *adaptive) add(n int) {
+	a.bytes += int64(n)
+}
+
+func (a *adaptive) pushback(err error) {
+	limit := a.limit / 2
+	if limit < 1 {
+		limit = 1
+	}
+	if limit != a.limit {
+		logrus.Infof("Server pushback, reduce connections to %d: %v", limit, err)
+	}
+	a.limit, a.probing, a.hold = limit, false, AdaptiveHold
+	// the throughput with fewer connections is the new baseline
+	a.best, a.bestPer = 0, 0
+}
+
+func (a *adaptive) tick(connections int) {
+	a.ticks++
+	if a.ticks < AdaptiveInterval {
+		return
+	}
+	speed := float64(a.bytes) / float64(a.ticks)
+	a.bytes, a.ticks = 0, 0
+
+	if connections > 0 {
+		per := speed / float64(connections)
+		if per > a.bestPer {
+			a.bestPer = per
+		} else if per < a.bestPer*AdaptiveCollapse && a.limit > 1 {
+			a.limit--
+			a.probing, a.hold = false, AdaptiveHold
+			logrus.Infof("Connection throughput collapsed to %s/s, reduce connections to %d", SizeToReadable(per), a.limit)
+			return
+		}
+	}
+
+	rising := speed > a.best*AdaptiveGrowth
+	if rising {
+		a.best = speed
+	}
+	if a.probing && !rising {
+		// the last connection did not help
+		a.limit--
+		a.probing, a.hold = false, AdaptiveHold
+		logrus.Debugf("Throughput stops rising at %s/s, keep %d connections", SizeToReadable(speed), a.limit)
+		return
+	}
+	a.probing = false
+	if a.hold > 0 {
+		a.hold--
+		if a.hold == 0 {
+			// probe again later, the network may have changed
+			a.best = speed
+		}
+		return
+	}
+	if connections >= a.limit && a.limit < a.max && speed > 0 {
+		a.limit++
+		a.probing = true
+		logrus.Debugf("Throughput %s/s, increase connections to %d", SizeToReadable(speed), a.limit)
+	}
+}
+
+// isPushback reports whether the server asks to slow down.
+func isPushback(err error) bool {
+	var e *Error
+	if errors.As(err, &e) && (e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable) {
+		return true
+	}
+	return isConnReset(err)
+}
@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptive(t *testing.T) {
+	a := newAdaptive(4)
+	if a.Limit() != AdaptiveInitialConnections {
+		t.Fatalf("Expect initial limit %d, got %d", AdaptiveInitialConnections, a.Limit())
+	}
+	interval := func(bytes int64, connections int) {
+		for i := 0; i < AdaptiveInterval; i++ {
+			a.add(int(bytes))
+			a.tick(connections)
+		}
+	}
+
+	// throughput rises with connections
+	interval(1000, 2)
+	if a.Limit() != 3 {
+		t.Errorf("Expect limit 3 while rising, got %d", a.Limit())
+	}
+	interval(1500, 3)
+	if a.Limit() != 4 {
+		t.Errorf("Expect limit 4 while rising, got %d", a.Limit())
+	}
+	interval(1500, 4)
+	if a.Limit() != 3 {
+		t.Errorf("Expect limit 3 after rising stops, got %d", a.Limit())
+	}
+
+	a.pushback(&Error{StatusCode: http.StatusServiceUnavailable})
+	if a.Limit() != 1 {
+		t.Errorf("Expect limit 1 after pushback, got %d", a.Limit())
+	}
+	for i := 0; i < AdaptiveHold; i++ {
+		interval(1000, 1)
+		if a.Limit() != 1 {
+			t.Errorf("Expect hold limit after pushback, got %d", a.Limit())
+		}
+	}
+
+	a = newAdaptive(4)
+	a.limit = 4
+	interval(4000, 4)
+	interval(400, 4)
+	if a.Limit() != 3 {
+		t.Errorf("Expect shedding after throughput collapse, got %d", a.Limit())
+	}
+
+	if !isPushback(&Error{StatusCode: http.StatusTooManyRequests}) || isPushback(&Error{StatusCode: http.StatusNotFound}) ||
+		isPushback(errors.New("other")) {
+		t.Error("Unexpected pushback detection")
+	}
+}
+
+func TestDownloadFileAdaptive(t *testing.T) {
+	size := int64(4 * 1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	modTime := time.Now().Add(-time.Hour)
+
+	var current, max int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+			return
+		}
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for m := atomic.LoadInt32(&max); n > m && !atomic.CompareAndSwapInt32(&max, m, n); m = atomic.LoadInt32(&max) {
+		}
+		if n > 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(&slowResponseWriter{ResponseWriter: w, delay: 40 * time.Millisecond}, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	d := NewDefaultDownloader()
+	d.Adaptive = true
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := d.DownloadFile(request, 8, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+	if max > 4 {
+		t.Errorf("Adaptive mode opens %d connections at once", max)
+	}
+}
@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// CheckpointInterval is the max time between two checkpoints of the state while downloading
+	CheckpointInterval = 10 * time.Second
+	// CheckpointBytes is the max bytes downloaded between two checkpoints
+	CheckpointBytes int64 = 64 * 1024 * 1024
+)
+
+// checkpoint saves the state of a download, only after the data it records is synced to disk.
+type checkpoint struct {
+	mutex     sync.Mutex
+	state     *State
+	file      *os.File
+	filename  string
+	stopped   bool
+	last      time.Time
+	remaining int64
+}
+
+func newCheckpoint(state *State, file *os.File, filename string) *checkpoint {
+	return &checkpoint{state: state, file: file, filename: filename, last: time.Now()}
+}
+
+// save syncs the data file and writes the state atomically.
+func (c *checkpoint) save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopped {
+		return nil
+	}
+	// the snapshot is taken before the sync, so it never records bytes written after the sync
+	b := c.state.ToByte()
+	remaining := c.state.Segments.Remaining()
+	if err := c.file.Sync(); err != nil {
+		return &Error{Op: "sync", Err: err}
+	}
+	if err := writeFileAtomic(c.filename, b); err != nil {
+		return &Error{Op: "write state", Err: err}
+	}
+	c.last, c.remaining = time.Now(), remaining
+	return nil
+}
+
+// tick saves if CheckpointInterval passed or CheckpointBytes are downloaded since the last save.
+func (c *checkpoint) tick(remaining int64) error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	if c.remaining < remaining {
+		// segments are initialized or removed after the last save
+		c.remaining = remaining
+	}
+	due := time.Since(c.last) >= CheckpointInterval || c.remaining-remaining >= CheckpointBytes
+	c.mutex.Unlock()
+	if !due {
+		return nil
+	}
+	return c.save()
+}
+
+// stop discards later saves, when the state is removed.
+func (c *checkpoint) stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stopped = true
+}
+
+// writeFileAtomic replaces the file by a synced temp file, so a crash leaves either the old or the new content.
+func writeFileAtomic(filename string, b []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	return nil
+}
@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpoint(t *testing.T) {
+	interval, limit := CheckpointInterval, CheckpointBytes
+	defer func() { CheckpointInterval, CheckpointBytes = interval, limit }()
+
+	size := int64(4 * 1024 * 1024)
+	src, dir, cleanup := newTestFile(t, size, "")
+	defer cleanup()
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+
+	cases := []struct {
+		name     string
+		interval time.Duration
+		bytes    int64
+	}{
+		{"interval", 200 * time.Millisecond, 1 << 40},
+		{"bytes", time.Hour, 64 * 1024},
+	}
+	for _, c := range cases {
+		CheckpointInterval, CheckpointBytes = c.interval, c.bytes
+		filename := filepath.Join(dir, c.name)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		// the rate limit keeps the download running for a few checkpoints
+		d := NewDefaultDownloader()
+		d.SetRateLimit(1024 * 1024)
+		go func() {
+			done <- d.DownloadFileContext(ctx, request, 4, filename)
+		}()
+
+		// the state is saved while downloading, and only records bytes on disk
+		var completed []ByteRange
+		for deadline := time.Now().Add(5 * time.Second); len(completed) == 0 && time.Now().Before(deadline); {
+			time.Sleep(50 * time.Millisecond)
+			b, _ := ioutil.ReadFile(filename + ".part.state")
+			if state, err := StateReadFromByte(b); err == nil {
+				completed = state.Segments.Completed()
+			}
+		}
+		cancel()
+		<-done
+		if len(completed) == 0 {
+			t.Fatalf("%s: expect a checkpoint while downloading", c.name)
+		}
+		data, _ := ioutil.ReadFile(filename + ".part")
+		for _, r := range completed {
+			if r.End > int64(len(data)) || !bytes.Equal(data[r.Begin:r.End], src[r.Begin:r.End]) {
+				t.Errorf("%s: state records %s which is not on disk", c.name, r)
+			}
+		}
+		if _, err := os.Stat(filename + ".part.state.tmp"); err == nil {
+			t.Errorf("%s: temp state file is left", c.name)
+		}
+	}
+}
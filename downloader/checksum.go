@@ -0,0 +1,128 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrChecksumMismatch    = errors.New("Checksum Mismatch")
+	ErrUnsupportChecksum   = errors.New("Unsupport Checksum Algorithm")
+	ErrWrongChecksumFormat = errors.New("Wrong Checksum Format")
+)
+
+// Checksum .
+type Checksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// ChecksumError .
+type ChecksumError struct {
+	Filename string
+	Expected *Checksum
+	Actual   []byte
+	// Suspect are all the ranges resumed from previous runs rather than located bad ranges. They are re-downloaded once
+	// before the file is quarantined, even if the bad data is in the ranges of this run.
+	Suspect []ByteRange
+}
+
+// NewHash .
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportChecksum, algorithm)
+}
+
+// NewChecksum .
+func NewChecksum(algorithm, sum string) (*Checksum, error) {
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(sum))
+	if err != nil || len(b) != h.Size() {
+		return nil, fmt.Errorf("%w: %s:%s", ErrWrongChecksumFormat, algorithm, sum)
+	}
+	return &Checksum{Algorithm: algorithm, Sum: b}, nil
+}
+
+// ParseChecksum .
+func ParseChecksum(s string) (*Checksum, error) {
+	index := strings.Index(s, ":")
+	if index < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrWrongChecksumFormat, s)
+	}
+	return NewChecksum(s[:index], s[index+1:])
+}
+
+func (c *Checksum) String() string {
+	return fmt.Sprintf("%s:%x", c.Algorithm, c.Sum)
+}
+
+// Verify .
+func (c *Checksum) Verify(r io.Reader) ([]byte, error) {
+	h, err := NewHash(c.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+	if !bytes.Equal(sum, c.Sum) {
+		return sum, ErrChecksumMismatch
+	}
+	return sum, nil
+}
+
+// VerifyFile .
+func (c *Checksum) VerifyFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sum, err := c.Verify(file)
+	if err == ErrChecksumMismatch {
+		return &ChecksumError{Filename: filename, Expected: c, Actual: sum}
+	}
+	return err
+}
+
+func (e *ChecksumError) Error() string {
+	msg := fmt.Sprintf("%s: %s expect %x, got %x", e.Filename, e.Expected.Algorithm, e.Expected.Sum, e.Actual)
+	if len(e.Suspect) > 0 {
+		ranges := make([]string, 0, len(e.Suspect))
+		for _, r := range e.Suspect {
+			ranges = append(ranges, r.String())
+		}
+		msg += ", re-download resumed ranges: " + strings.Join(ranges, ", ")
+	}
+	return msg
+}
+
+// Unwrap .
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
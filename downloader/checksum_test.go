@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("gget"))
+	c, err := ParseChecksum("SHA256:" + hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Algorithm != "sha256" || !bytes.Equal(c.Sum, sum[:]) {
+		t.Errorf("Unexpected checksum %s", c)
+	}
+	if _, err = c.Verify(bytes.NewReader([]byte("gget"))); err != nil {
+		t.Error(err)
+	}
+
+	for _, s := range []string{"sha256", "sha256:xyz", "md5:" + hex.EncodeToString(sum[:]), "crc32:00000000"} {
+		if _, err = ParseChecksum(s); err == nil {
+			t.Errorf("Expect error for %s", s)
+		}
+	}
+}
+
+func TestDownloadFileChecksum(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	sum := sha256.Sum256(src)
+
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+
+	d := NewDefaultDownloader()
+	d.Checksum = &Checksum{Algorithm: "sha256", Sum: sum[:]}
+
+	// corrupt the first half which was downloaded by a previous run
+	stale := make([]byte, size/2)
+	state := NewState(server.URL)
+	state.Validator = Validator{ETag: `"v1"`, Length: size}
+	state.Segments = NewSegments([]*Segment{{begin: 0, position: size / 2, end: size}})
+	ioutil.WriteFile(filename, stale, 0644)
+	ioutil.WriteFile(filename+".state", state.ToByte(), 0644)
+
+	err := d.DownloadFile(request, 4, filename)
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || len(checksumErr.Suspect) != 1 || checksumErr.Suspect[0] != (ByteRange{0, size / 2}) {
+		t.Fatalf("Expect suspect region 0-%d, got %v", size/2, err)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("Error should be retryable: %v", err)
+	}
+
+	if err = d.DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch after re-download resumed ranges")
+	}
+
+	d.Checksum = &Checksum{Algorithm: "sha256", Sum: make([]byte, sha256.Size)}
+	os.Remove(filename)
+	os.Remove(filename + ".state")
+	err = d.DownloadFile(request, 4, filename)
+	if !errors.Is(err, ErrChecksumMismatch) || IsRetryable(err) {
+		t.Errorf("Expect unretryable %v, got %v", ErrChecksumMismatch, err)
+	}
+	if _, err = os.Stat(filename + ".corrupt"); err != nil {
+		t.Errorf("Corrupt file should be quarantined: %v", err)
+	}
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Corrupt file should be removed: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrFileExists .
+var ErrFileExists = errors.New("File Exists")
+
+// ConflictPolicy decides what to do with an existing file which has no state file.
+type ConflictPolicy string
+
+// Conflict policies, the default continues the existing file as a partial download.
+const (
+	ConflictContinue  ConflictPolicy = ""
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictRename    ConflictPolicy = "rename"
+	ConflictFail      ConflictPolicy = "fail"
+)
+
+// ParseConflictPolicy .
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictContinue, ConflictOverwrite, ConflictSkip, ConflictRename, ConflictFail:
+		return policy, nil
+	case "continue":
+		return ConflictContinue, nil
+	}
+	return "", fmt.Errorf("Unknown conflict policy %q", s)
+}
+
+func exists(filename string) bool {
+	_, err := os.Lstat(filename)
+	return err == nil
+}
+
+// resolveConflict returns the filename to download into, and whether to skip the download.
+func (d *Downloader) resolveConflict(filename string) (string, bool, error) {
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", false, &Error{Op: "mkdir", Err: err}
+		}
+	}
+	if !exists(filename) || exists(filename+".state") {
+		return filename, false, nil
+	}
+
+	switch d.Conflict {
+	case ConflictOverwrite:
+		logrus.Infof("Overwrite existing %s", filename)
+		if err := os.Remove(filename); err != nil {
+			return "", false, &Error{Op: "remove", Err: err}
+		}
+	case ConflictSkip:
+		logrus.Infof("Skip existing %s", filename)
+		return filename, true, nil
+	case ConflictRename:
+		for i := 1; ; i++ {
+			// an interrupted download into a renamed file is continued
+			name := fmt.Sprintf("%s.%d", filename, i)
+			if !exists(name) || exists(name+".state") {
+				logrus.Infof("%s exists, download into %s", filename, name)
+				return name, false, nil
+			}
+		}
+	case ConflictFail:
+		return "", false, &Error{Op: "open", Err: fmt.Errorf("%w: %s", ErrFileExists, filename)}
+	}
+	return filename, false, nil
+}
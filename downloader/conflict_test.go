@@ -0,0 +1,110 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileConflict(t *testing.T) {
+	src := []byte("remote content")
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "gget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := []byte("unrelated file")
+	filename := filepath.Join(dir, "sub", "file")
+	cases := []struct {
+		policy   ConflictPolicy
+		err      error
+		filename string
+		content  []byte
+	}{
+		{ConflictSkip, nil, filename, old},
+		{ConflictFail, ErrFileExists, filename, old},
+		{ConflictRename, nil, filename + ".1", src},
+		{ConflictOverwrite, nil, filename, src},
+	}
+	for _, c := range cases {
+		os.RemoveAll(dir)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		ioutil.WriteFile(filename, old, 0644)
+
+		d := NewDefaultDownloader()
+		d.Directory = filepath.Join(dir, "sub")
+		d.Conflict = c.policy
+		request, _ := http.NewRequest("GET", server.URL+"/file", nil)
+		if err := d.DownloadFile(request, 4, ""); !errors.Is(err, c.err) {
+			t.Errorf("Policy %s: expect %v, got %v", c.policy, c.err, err)
+		}
+		if b, _ := ioutil.ReadFile(c.filename); !bytes.Equal(b, c.content) {
+			t.Errorf("Policy %s: unexpected content of %s: %q", c.policy, c.filename, b)
+		}
+		if c.filename != filename {
+			if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, old) {
+				t.Errorf("Policy %s: existing file is modified", c.policy)
+			}
+		}
+	}
+
+	// an existing state file means an interrupted download, which is continued rather than renamed
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	d := NewDefaultDownloader()
+	d.Directory = dir
+	d.Conflict = ConflictRename
+	ioutil.WriteFile(filepath.Join(dir, "file"), old, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "file.1"), src[:4], 0644)
+	ioutil.WriteFile(filepath.Join(dir, "file.1.state"), []byte("0-4-14"), 0644)
+	request, _ := http.NewRequest("GET", server.URL+"/file", nil)
+	if err := d.DownloadFile(request, 4, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "file.1")); !bytes.Equal(b, src) {
+		t.Errorf("Unexpected content %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.2")); err == nil {
+		t.Error("Expect file.1 continued rather than file.2")
+	}
+}
+
+func TestDownloadFileConflictContinue(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	var transferred int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(&countResponseWriter{ResponseWriter: w, count: &transferred}, r, "test", time.Now().Add(-time.Hour), bytes.NewReader(src))
+	}))
+	defer server.Close()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+
+	// an existing file without state is continued from its size in both single and multi thread downloads
+	for _, thread := range []int{1, 4} {
+		for _, existing := range []int64{size / 2, size} {
+			ioutil.WriteFile(filename, src[:existing], 0644)
+			atomic.StoreInt64(&transferred, 0)
+			if err := NewDefaultDownloader().DownloadFile(request, thread, filename); err != nil {
+				t.Fatalf("Thread %d: %v", thread, err)
+			}
+			if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+				t.Errorf("Thread %d from %d: content mismatch", thread, existing)
+			}
+			// the existing bytes are not downloaded again, besides the small body of a 416 response
+			if transferred := atomic.LoadInt64(&transferred); transferred > size-existing+1024 {
+				t.Errorf("Thread %d from %d: transferred %d bytes", thread, existing, transferred)
+			}
+		}
+	}
+}
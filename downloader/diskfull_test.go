@@ -0,0 +1,50 @@
+//go:build !plan9
+// +build !plan9
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// fullWriterAt fails with ENOSPC after limit bytes.
+type fullWriterAt struct {
+	mutex   sync.Mutex
+	limit   int
+	written int
+}
+
+func (w *fullWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.written+len(b) > w.limit {
+		n := w.limit - w.written
+		w.written = w.limit
+		return n, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+	}
+	w.written += len(b)
+	return len(b), nil
+}
+
+func TestMultiThreadDownloadDiskFull(t *testing.T) {
+	size := int64(1024 * 1024)
+	src := make([]byte, size)
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	segments := NewSegments(nil)
+	err := NewDefaultDownloader().MultiThreadDownloadContext(context.Background(), request, segments, &fullWriterAt{limit: 300 * 1024}, "test-full", size, 4)
+	if !errors.Is(err, ErrDiskFull) || IsRetryable(err) {
+		t.Fatalf("Expect disk full error which is not retryable, got %v", err)
+	}
+	if done := size - segments.Remaining(); done != 300*1024 {
+		t.Errorf("Expect %d bytes recorded in segments, got %d", 300*1024, done)
+	}
+}
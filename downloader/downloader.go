@@ -10,7 +10,10 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chentanyi/go-utils/filehash"
@@ -27,19 +30,46 @@ var (
 
 // Downloader .
 type Downloader struct {
-	Client *http.Client
+	Client            *http.Client
+	Checksum          *Checksum
+	ChecksumURL       string
+	ChecksumDiscovery bool
+	Limiter           *RateLimiter
+	Observer          Observer
+	// Adaptive tunes the connection count between 1 and threadCount by throughput and server pushback
+	Adaptive bool
+	Retry    *RetryPolicy
+	// Directory is where files named by url or response are saved
+	Directory string
+	Conflict  ConflictPolicy
+	// InPlace downloads into the final filename and keeps its state file, rather than renaming a synced .part file on completion
+	InPlace bool
+
+	// mutex guards Limiter, which SetRateLimit creates if nil while jobs are reading it
+	mutex sync.Mutex
 }
 
 // Job .
 type Job struct {
-	Index    int
-	Segment  *Segment
-	Response *http.Response
+	// received is first for 64-bit alignment of atomic access, it counts the bytes written since the last tick
+	received int64
+
+	Index   int
+	Segment *Segment
+	Mirror  *Mirror
+
+	// attempt identifies the current run of the job, a stalled or failed job is restarted as a new attempt
+	attempt  uint64
+	cancel   context.CancelFunc
+	failures int
+	retrying bool
 }
 
+// result is sent when an attempt of job finishes its segment or fails.
 type result struct {
-	job *Job
-	b   []byte
+	job     *Job
+	attempt uint64
+	err     error
 }
 
 // NewDefaultDownloader .
@@ -50,18 +80,38 @@ func NewDefaultDownloader() *Downloader {
 	d.Client = &http.Client{
 		Jar: jar,
 	}
+	d.Limiter = NewRateLimiter(0)
 	return d
 }
 
 // NewDownloader .
 func NewDownloader(client *http.Client) *Downloader {
 	d := &Downloader{
-		Client: client,
+		Client:  client,
+		Limiter: NewRateLimiter(0),
 	}
 
 	return d
 }
 
+// SetRateLimit sets the total bytes per second of all connections, it is safe to call during download.
+func (d *Downloader) SetRateLimit(rate int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.Limiter == nil {
+		d.Limiter = NewRateLimiter(rate)
+		return
+	}
+	d.Limiter.SetRate(rate)
+}
+
+// rateLimiter .
+func (d *Downloader) rateLimiter() *RateLimiter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.Limiter
+}
+
 // NewJob .
 func NewJob(Segment *Segment, index int) *Job {
 	return &Job{
@@ -81,82 +131,406 @@ func (d *Downloader) Download(uri string) error {
 }
 
 // DownloadFile .
-func (d *Downloader) DownloadFile(request *http.Request, threadCount int, filename string) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("%+v", r)
-		}
-	}()
+func (d *Downloader) DownloadFile(request *http.Request, threadCount int, filename string) error {
+	return d.DownloadFileContext(context.Background(), request, threadCount, filename)
+}
+
+// DownloadFileContext .
+func (d *Downloader) DownloadFileContext(ctx context.Context, request *http.Request, threadCount int, filename string) error {
+	return d.DownloadFileMirrorsContext(ctx, []*http.Request{request}, threadCount, filename)
+}
+
+// DownloadFileMirrors .
+func (d *Downloader) DownloadFileMirrors(requests []*http.Request, threadCount int, filename string) error {
+	return d.DownloadFileMirrorsContext(context.Background(), requests, threadCount, filename)
+}
+
+// DownloadFileMirrorsContext downloads one file from several equivalent urls, the first one is the primary.
+func (d *Downloader) DownloadFileMirrorsContext(ctx context.Context, requests []*http.Request, threadCount int, filename string) error {
+	return d.download(ctx, &task{requests: requests, threadCount: threadCount, filename: filename, checksum: d.Checksum})
+}
 
+// task is one file to download, from the command line or a metalink.
+type task struct {
+	requests    []*http.Request
+	priorities  []int
+	filename    string
+	threadCount int
+	size        int64
+	checksum    *Checksum
+	pieces      *Pieces
+}
+
+func (d *Downloader) download(ctx context.Context, t *task) (err error) {
+	if len(t.requests) == 0 {
+		return ErrNoMirror
+	}
+	filename, threadCount := t.filename, t.threadCount
+	request := t.requests[0]
 	if filename == "" {
-		filename = ExtractFilenameFromURI(request.URL)
+		filename = filepath.Join(d.Directory, d.resolveFilename(ctx, request))
 	}
+	filename, skip, err := d.resolveConflict(filename)
+	if err != nil || skip {
+		return err
+	}
+	part, moved, err := d.partFilename(filename)
+	if err != nil {
+		return err
+	}
+	if moved {
+		defer func() {
+			if err != nil {
+				restorePart(part, filename)
+			}
+		}()
+	}
+	progress := d.newTracker(filename)
+	defer func() { progress.finish(err) }()
 	if threadCount < 1 {
 		threadCount = 16
 	}
+
+	checksum := t.checksum
+	if checksum == nil && (d.ChecksumDiscovery || d.ChecksumURL != "") {
+		checksum, err = d.DiscoverChecksumContext(ctx, request, d.ChecksumURL)
+		if err != nil {
+			if d.ChecksumURL != "" || ctx.Err() != nil {
+				return err
+			}
+			logrus.Warnf("No checksum found for %s, skip verification", request.URL)
+		}
+	}
+
+	policy := d.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		err = d.attempt(ctx, t, part, threadCount, checksum, progress)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrDiskFull) {
+			logrus.Errorf("Disk is full, %s is paused and can be continued after space is freed", filename)
+		}
+		if !IsRetryable(err) || policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return err
+		}
+		delay := policy.Backoff(attempt, RetryAfter(err))
+		logrus.Warnf("Download %s error: %v, retry in %s", filename, err, delay)
+		progress.retry(err)
+		if err = sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+	if part == filename {
+		return nil
+	}
+	return finalize(part, filename)
+}
+
+// resolveFilename names the file by Content-Disposition or the url after redirects.
+func (d *Downloader) resolveFilename(ctx context.Context, request *http.Request) string {
+	remote, err := d.DetectRemoteContext(ctx, request)
+	if err != nil {
+		logrus.Debugf("Detect filename of %s error: %v", request.URL, err)
+		return ExtractFilenameFromURI(request.URL)
+	}
+	logrus.Debugf("Get filename %s", remote.Filename)
+	return remote.Filename
+}
+
+// attempt downloads the file once, it continues from the state of previous attempts.
+func (d *Downloader) attempt(ctx context.Context, t *task, filename string, threadCount int, checksum *Checksum, progress *tracker) error {
+	request := t.requests[0]
 	if threadCount == 1 {
-		return d.SingleThreadDownload(request, filename)
+		return d.singleThreadDownload(ctx, request, filename, checksum, progress)
 	}
 
-	canContinue, contentLength, err := d.DetectContinueDownload(request)
+	remote, mirrors, err := d.detectMirrors(ctx, t)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if !canContinue {
-		return d.SingleThreadDownload(request, filename)
+	if remote == nil {
+		return d.singleThreadDownload(ctx, request, filename, checksum, progress)
 	}
+	contentLength := remote.Length
+	primary := mirrors.Mirrors()[0].Request.URL.String()
 
 	stateFilename := filename + ".state"
-	stateFile, err := os.OpenFile(stateFilename, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		panic(err)
+	b, err := ioutil.ReadFile(stateFilename)
+	if err != nil && !os.IsNotExist(err) {
+		return &Error{Op: "read state", URL: request.URL.String(), Err: err}
 	}
-	defer stateFile.Close()
-	state, err := ioutil.ReadAll(stateFile)
-	if err != nil {
-		panic(err)
+	state, err := StateReadFromByte(b)
+	restart := false
+	if errors.Is(err, ErrStateCorrupt) {
+		logrus.Warnf("State file %s is corrupt, restart %s", stateFilename, filename)
+		state, restart = NewState(), true
+	} else if err != nil {
+		return &Error{Op: "parse state", URL: request.URL.String(), Err: err}
+	} else if len(state.URLs) > 0 && state.URLs[0] == primary && !state.Validator.Match(remote.Validator) ||
+		!state.Validator.Equivalent(remote.Validator) && !state.Validator.Empty() {
+		logrus.Warnf("Remote file changed since last download, restart %s", filename)
+		state, restart = NewState(), true
+	} else if state.Validator.Empty() && len(state.Segments.Segments()) > 0 {
+		logrus.Warnf("No validator in %s, cannot check whether remote file changed", stateFilename)
 	}
-	segments, err := SegmentsReadFromByte(state)
+	state.URLs = state.URLs[:0]
+	for _, mirror := range mirrors.Mirrors() {
+		state.URLs = append(state.URLs, mirror.Request.URL.String())
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "open", URL: request.URL.String(), Err: err}
 	}
+	defer file.Close()
 
+	if len(b) == 0 {
+		// a file without state is continued as a partial download, like the single thread download
+		info, err := file.Stat()
+		if err != nil {
+			return &Error{Op: "stat", URL: request.URL.String(), Err: err}
+		}
+		if size := info.Size(); size > contentLength {
+			logrus.Warnf("Remote file is %d bytes rather than %d, restart %s", contentLength, size, filename)
+			restart = true
+		} else if size > 0 {
+			logrus.Infof("Continue %s from %d without state", filename, size)
+			state.Segments = NewSegments([]*Segment{{begin: 0, position: size, end: contentLength}})
+		}
+	}
+	if restart {
+		if err = file.Truncate(0); err != nil {
+			return &Error{Op: "truncate", URL: request.URL.String(), Err: err}
+		}
+		t.pieces.reset()
+	}
+	state.Validator = remote.Validator
+	segments := state.Segments
+	resumed := segments.Completed()
+
+	checkpoint := newCheckpoint(state, file, stateFilename)
 	saveSegments := func() {
-		b := segments.ToByte()
-		fmt.Printf("Segments: %s\n", string(b))
-		stateFile.Truncate(0)
-		stateFile.WriteAt(b, 0)
+		if d.Observer == nil {
+			fmt.Printf("Segments: %s\n", segments)
+		}
+		if err := checkpoint.save(); err != nil {
+			logrus.Errorf("Save state of %s error: %v", filename, err)
+		}
+	}
+	// the state on disk may record the truncated data
+	if err = checkpoint.save(); err != nil {
+		return err
 	}
 	defer saveSegments()
 	interrupt.Add("saveSegments", saveSegments)
 	defer interrupt.Remove("saveSegments")
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		panic(err)
+	if err = preallocate(file, contentLength); err != nil {
+		return &Error{Op: "preallocate", URL: request.URL.String(), Err: err}
+	}
+	err = d.multiThreadDownload(ctx, mirrors, segments, t.pieces, file, filename, contentLength, threadCount, progress, checkpoint)
+	if err != nil || checksum == nil {
+		return err
 	}
 
-	return d.MultiThreadDownload(request, segments, file, filename, contentLength, threadCount)
+	var checksumErr *ChecksumError
+	if err = checksum.VerifyFile(filename); !errors.As(err, &checksumErr) {
+		state.Suspect = nil
+		return err
+	}
+	if len(resumed) > 0 && len(state.Suspect) == 0 {
+		// the bad data cannot be located by the whole file checksum, every resumed range is suspected
+		logrus.Warnf("Checksum mismatch, re-download the ranges of %s resumed from previous runs", filename)
+		for _, r := range resumed {
+			segments.Remove(r.Begin, r.End)
+		}
+		t.pieces.reset()
+		state.Suspect = resumed
+		checksumErr.Suspect = resumed
+		return checksumErr
+	}
+
+	checkpoint.stop()
+	file.Close()
+	return Quarantine(filename, checksumErr)
 }
 
 // MultiThreadDownload .
-func (d *Downloader) MultiThreadDownload(request *http.Request, segments *Segments, file io.WriterAt, filename string, contentLength int64, threadCount int) (err error) {
+func (d *Downloader) MultiThreadDownload(request *http.Request, segments *Segments, file io.WriterAt, filename string, contentLength int64, threadCount int) error {
+	return d.MultiThreadDownloadContext(context.Background(), request, segments, file, filename, contentLength, threadCount)
+}
+
+// MultiThreadDownloadContext .
+func (d *Downloader) MultiThreadDownloadContext(ctx context.Context, request *http.Request, segments *Segments, file io.WriterAt, filename string, contentLength int64, threadCount int) (err error) {
+	progress := d.newTracker(filename)
+	defer func() { progress.finish(err) }()
+	return d.multiThreadDownload(ctx, NewMirrors(request), segments, nil, file, filename, contentLength, threadCount, progress, nil)
+}
+
+// detectMirrors returns the primary remote and mirrors which support range and serve the same file,
+// the remote is nil if no mirror supports range.
+func (d *Downloader) detectMirrors(ctx context.Context, t *task) (*Remote, *Mirrors, error) {
+	requests := t.requests
+	remotes := make([]*Remote, len(requests))
+	errs := make([]error, len(requests))
+	wg := sync.WaitGroup{}
+	for i := range requests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			remotes[i], errs[i] = d.DetectRemoteContext(ctx, requests[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var primary *Remote
+	available := make([]*http.Request, 0, len(requests))
+	priorities := make([]int, 0, len(requests))
+	for i, request := range requests {
+		if errs[i] != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			logrus.Warnf("Detect %s error: %v", request.URL, errs[i])
+			continue
+		}
+		if !remotes[i].Range {
+			logrus.Warnf("Mirror %s does not support range", request.URL)
+			continue
+		}
+		if t.size > 0 && remotes[i].Length != t.size {
+			logrus.Warnf("Mirror %s serves a different file, length = %d, expect %d", request.URL, remotes[i].Length, t.size)
+			continue
+		}
+		if primary == nil {
+			primary = remotes[i]
+		} else if !primary.Equivalent(remotes[i].Validator) {
+			logrus.Warnf("Mirror %s serves a different file, length = %d, etag = %s, last modified = %s", request.URL,
+				remotes[i].Length, remotes[i].ETag, remotes[i].LastModified)
+			continue
+		}
+		req := request.Clone(ctx)
+		SetIfRange(req, remotes[i].Validator)
+		available = append(available, req)
+		if i < len(t.priorities) {
+			priorities = append(priorities, t.priorities[i])
+		}
+	}
+
+	if primary == nil {
+		for _, err := range errs {
+			if err == nil {
+				return nil, nil, nil
+			}
+		}
+		return nil, nil, errs[0]
+	}
+	mirrors := NewMirrors(available...)
+	for i, priority := range priorities {
+		mirrors.Mirrors()[i].Priority = priority
+	}
+	return primary, mirrors, nil
+}
+
+func (d *Downloader) multiThreadDownload(ctx context.Context, mirrors *Mirrors, segments *Segments, pieces *Pieces, file io.WriterAt, filename string, contentLength int64, threadCount int, progress *tracker, checkpoint *checkpoint) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	segments.InitSize(contentLength)
+	src, verify := file.(io.ReaderAt)
+	verify = verify && pieces != nil
 	jobs := make([]*Job, threadCount)
 	resultChan := make(chan *result, threadCount)
+	retryChan := make(chan *Job, threadCount)
+	policy := d.retryPolicy()
+	retries := 0
+	// spend counts a failure of job, and returns false if the retry budget is exhausted
+	spend := func(job *Job, err error) bool {
+		retries++
+		job.failures++
+		progress.retry(err)
+		if policy.DownloadRetries > 0 && retries > policy.DownloadRetries {
+			logrus.Warnf("Download %s failed %d times, give up", filename, retries)
+			return false
+		}
+		if policy.SegmentRetries > 0 && job.failures > policy.SegmentRetries {
+			logrus.Warnf("Segment %s failed %d times, give up", job.Segment, job.failures)
+			return false
+		}
+		return true
+	}
+	startJob := func(job *Job) {
+		if job.cancel != nil {
+			job.cancel()
+		}
+		var jobCtx context.Context
+		jobCtx, job.cancel = context.WithCancel(ctx)
+		job.Mirror = mirrors.Pick(jobs)
+		job.attempt = newAttempt()
+		job.Segment.own(job.attempt)
+		go d.runAttempt(jobCtx, job.Mirror.Request, job, job.attempt, resultChan)
+	}
+	var adapt *adaptive
+	if d.Adaptive {
+		adapt = newAdaptive(threadCount)
+	}
+	// newJob creates and starts a job at an empty or finished slot, if the connection limit allows
+	newJob := func(index int) error {
+		if adapt != nil && activeJobs(jobs) >= adapt.Limit() {
+			jobs[index] = nil
+			return nil
+		}
+		if err := d.CreateNewJob(segments, jobs, index, file); err != nil {
+			return err
+		}
+		if jobs[index] != nil {
+			startJob(jobs[index])
+		}
+		return nil
+	}
+	// stopJob releases the segment of a job for other jobs
+	stopJob := func(index int) {
+		job := jobs[index]
+		if job.cancel != nil {
+			job.cancel()
+		}
+		job.Segment.Release()
+		jobs[index] = nil
+	}
+
+	// jobsCount marks the jobs which wrote since the last read timeout check
+	jobsCount := make([]bool, threadCount)
+	// collect counts the bytes written by the job at index since the last call
+	collect := func(index int) {
+		job := jobs[index]
+		if job == nil {
+			return
+		}
+		if n := atomic.SwapInt64(&job.received, 0); n > 0 {
+			job.failures = 0
+			jobsCount[index] = true
+			mirrors.Add(job.Mirror, int(n))
+			if adapt != nil {
+				adapt.add(int(n))
+			}
+		}
+	}
 
 	logrus.Debugf("Read %d Segments: %+v", len(segments.Segments()), segments)
+	progress.start(contentLength-segments.Remaining(), contentLength)
 
 	for i := 0; i < threadCount; i++ {
-		d.CreateNewJob(segments, jobs, i, file)
-		if jobs[i] != nil {
-			go d.StartJob(request, jobs[i], resultChan)
+		if err = newJob(i); err != nil {
+			return err
 		}
 	}
 
 	remaining := segments.Remaining()
 	for remaining > 0 {
-		jobsCount := make([]bool, threadCount)
+		for i := range jobsCount {
+			jobsCount[i] = false
+		}
 		timer := time.NewTicker(time.Second)
 		timerCount := 0
 		for { // per read timeout
@@ -165,65 +539,138 @@ func (d *Downloader) MultiThreadDownload(request *http.Request, segments *Segmen
 				select {
 				case res := <-resultChan:
 					index := res.job.Index
-					jobsCount[index] = true
-					logrus.Debugf("Receive %s %v", res.job.Segment, res.b)
-					_, err = res.job.Segment.Write(res.b)
-					if err != nil {
-						if err != ErrSegmentFinish {
-							return err
+					if jobs[index] != res.job || res.attempt != res.job.attempt {
+						// stopped job or stale attempt
+						continue
+					}
+					collect(index)
+					if res.err != nil {
+						var e *Error
+						if errors.As(res.err, &e) && e.Op == "write" {
+							// a local write error is not the fault of mirror
+							return res.err
+						}
+						dropped := mirrors.Fail(res.job.Mirror, res.err)
+						if !dropped && (!IsRetryable(res.err) || errors.Is(res.err, ErrRemoteChanged)) {
+							return res.err
+						}
+						logrus.Debugf("Job %d error: %v", index, res.err)
+						if !spend(res.job, res.err) {
+							return res.err
+						}
+						if adapt != nil && isPushback(res.err) {
+							// back off, the slot is refilled at next tick if the limit allows
+							adapt.pushback(res.err)
+							stopJob(index)
+							continue
 						}
+						if res.job.Segment.Finish() {
+							continue
+						}
+						// switch to another mirror at once, or back off the only mirror
+						if dropped || len(mirrors.Active()) > 1 {
+							startJob(res.job)
+							continue
+						}
+						job := res.job
+						job.retrying = true
+						delay := policy.Backoff(job.failures, RetryAfter(res.err))
+						logrus.Debugf("Retry job %d in %s", index, delay)
+						time.AfterFunc(delay, func() {
+							select {
+							case retryChan <- job:
+							case <-ctx.Done():
+							}
+						})
+						continue
 					}
 					if res.job.Segment.Finish() {
-						if res.job.Response != nil {
-							err = res.job.Response.Body.Close()
-							if err != nil {
-								logrus.Errorf("Close Response Body Error: %v", err)
-							}
+						if err = newJob(index); err != nil {
+							return err
 						}
-					}
-					if jobs[index] != nil && jobs[index].Segment.Finish() {
-						d.CreateNewJob(segments, jobs, index, file)
-						if jobs[index] != nil {
-							go d.StartJob(request, jobs[index], resultChan)
+						if segments.Remaining() == 0 {
+							// finish without waiting for the tick
+							break LoopPerSecond
 						}
 					}
+				case job := <-retryChan:
+					job.retrying = false
+					if jobs[job.Index] == job && !job.Segment.Finish() {
+						startJob(job)
+					}
 				case <-timer.C:
 					break LoopPerSecond
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
 				}
 			}
 
+			for i := range jobs {
+				collect(i)
+			}
+			mirrors.Tick()
+			if adapt != nil {
+				adapt.tick(activeJobs(jobs))
+				for i := len(jobs) - 1; i >= 0 && activeJobs(jobs) > adapt.Limit(); i-- {
+					if jobs[i] != nil && !jobs[i].Segment.Finish() {
+						stopJob(i)
+					}
+				}
+			}
+			if verify {
+				bad, err := pieces.Verify(src, segments.Completed(), contentLength)
+				if err != nil {
+					return err
+				}
+				for _, r := range bad {
+					segments.Remove(r.Begin, r.End)
+				}
+			}
 			current := segments.Remaining()
-			logrus.Infof("Download %s: %s / %s, speed %s/s", filename, SizeToReadable(float64(contentLength-current)),
-				SizeToReadable(float64(contentLength)), SizeToReadable(float64(remaining-current)))
+			if progress != nil {
+				progress.update(contentLength-current, activeJobs(jobs), segmentProgress(segments))
+			} else {
+				logrus.Infof("Download %s: %s / %s, speed %s/s", filename, SizeToReadable(float64(contentLength-current)),
+					SizeToReadable(float64(contentLength)), SizeToReadable(float64(remaining-current)))
+			}
+			if err = checkpoint.tick(current); err != nil {
+				logrus.Warnf("Checkpoint %s error: %v", filename, err)
+			}
 			logrus.Debugf("Left %d", current)
 			logrus.Debugf("Current Segments: %s", segments)
 			remaining = current
 			if remaining <= 0 {
+				timer.Stop()
 				break
 			}
 
 			timerCount++
 			for i, job := range jobs {
 				if job == nil {
-					d.CreateNewJob(segments, jobs, i, file)
+					if err = newJob(i); err != nil {
+						return err
+					}
 					jobsCount[i] = false
 				}
 				job = jobs[i]
 				if job != nil {
 					if timerCount == int(ReadTimeout/time.Second)+1 {
-						if !jobsCount[i] && !job.Segment.Finish() {
-							if job.Response != nil {
-								err = job.Response.Body.Close()
-								if err != nil {
-									logrus.Errorf("Close Response Body Error: %v", err)
+						if !jobsCount[i] && !job.Segment.Finish() && !job.retrying {
+							if job.Mirror != nil {
+								timeoutErr := NewRequestError("read", job.Mirror.Request, job.Segment.Current(), job.Segment.End(), ErrReadTimeout)
+								mirrors.Fail(job.Mirror, timeoutErr)
+								if !spend(job, timeoutErr) {
+									return timeoutErr
 								}
 							}
-							go d.StartJob(request, job, resultChan)
+							startJob(job)
 						}
 					}
 				}
 			}
 			if timerCount == int(ReadTimeout/time.Second)+1 {
+				timer.Stop()
 				break
 			}
 		}
@@ -233,8 +680,18 @@ func (d *Downloader) MultiThreadDownload(request *http.Request, segments *Segmen
 	return nil
 }
 
+func activeJobs(jobs []*Job) int {
+	count := 0
+	for _, job := range jobs {
+		if job != nil && !job.Segment.Finish() {
+			count++
+		}
+	}
+	return count
+}
+
 // CreateNewJob .
-func (d *Downloader) CreateNewJob(segments *Segments, jobs []*Job, index int, dst io.WriterAt) {
+func (d *Downloader) CreateNewJob(segments *Segments, jobs []*Job, index int, dst io.WriterAt) error {
 	seg, err := segments.Start(index+1, dst)
 	if seg == nil {
 		if err != ErrAllSegmentIsFinish {
@@ -242,128 +699,330 @@ func (d *Downloader) CreateNewJob(segments *Segments, jobs []*Job, index int, ds
 				err = fmt.Errorf("Job already exists when start, id: %d", index+1)
 			}
 			logrus.Debugf("Segments %s", segments)
-			panic(err)
+			return err
 		}
 		jobs[index] = nil
 	} else {
 		jobs[index] = NewJob(seg, index)
 	}
+	return nil
 }
 
 // StartJob .
 func (d *Downloader) StartJob(req *http.Request, job *Job, resultChan chan<- *result) {
-	chanWriter := NewChanWriter(8)
+	d.StartJobContext(context.Background(), req, job, resultChan)
+}
 
-	go func() {
-		request := req.Clone(context.Background())
-		SetRange(request, job.Segment.Current(), job.Segment.End()-1)
+// StartJobContext downloads the segment of job as a new attempt, and writes into it directly.
+// The result is sent when it stops, a previous attempt of the job must be cancelled before.
+func (d *Downloader) StartJobContext(ctx context.Context, req *http.Request, job *Job, resultChan chan<- *result) {
+	job.attempt = newAttempt()
+	job.Segment.own(job.attempt)
+	d.runAttempt(ctx, req, job, job.attempt, resultChan)
+}
 
-		response, err := d.Client.Do(request)
-		if err != nil {
-			return
-		}
-		defer response.Body.Close()
+func (d *Downloader) runAttempt(ctx context.Context, req *http.Request, job *Job, attempt uint64, resultChan chan<- *result) {
+	err := d.runJob(ctx, req, job, attempt)
+	if ctx.Err() != nil {
+		// stopped job
+		return
+	}
+	select {
+	case resultChan <- &result{job: job, attempt: attempt, err: err}:
+	case <-ctx.Done():
+	}
+}
 
-		if response.StatusCode != 206 || (job.Segment.Current() == 0 && response.StatusCode >= 300) {
-			panic(errors.New("Unable to get partial content from server"))
-		}
+func (d *Downloader) runJob(ctx context.Context, req *http.Request, job *Job, attempt uint64) error {
+	request := req.Clone(ctx)
+	begin, end := job.Segment.Current(), job.Segment.End()
+	SetRange(request, begin, end-1)
 
-		job.Response = response
-		io.Copy(chanWriter, response.Body)
-	}()
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return NewRequestError("request", request, begin, end, err)
+	}
+	defer response.Body.Close()
 
+	if RemoteChanged(request, response) {
+		return &Error{Op: "request", URL: request.URL.String(), StatusCode: response.StatusCode,
+			Begin: begin, End: end, Retryable: true, Err: ErrRemoteChanged}
+	}
+	if length := ContentRangeLength(response); response.StatusCode == http.StatusRequestedRangeNotSatisfiable && length >= 0 && length < end {
+		return &Error{Op: "request", URL: request.URL.String(), StatusCode: response.StatusCode,
+			Begin: begin, End: end, Retryable: true, Err: ErrRemoteChanged}
+	}
+	if response.StatusCode != 206 {
+		return NewStatusError("request", response, begin, end)
+	}
+
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	reader := NewRateLimitedReader(ctx, response.Body, d.rateLimiter())
+	offset := begin
 	for {
-		select {
-		case b := <-chanWriter.Chan():
-			logrus.Debugf("chan %v receive %v", chanWriter.Chan(), b)
-			resultChan <- &result{job, b}
-		case <-time.After(ReadTimeout):
-			return
+		n, readErr := readCoalesced(reader, *buffer, WriteInterval)
+		if n > 0 {
+			written, err := job.Segment.writeAttempt((*buffer)[:n], offset, attempt)
+			offset += int64(written)
+			atomic.AddInt64(&job.received, int64(written))
+			if err == ErrSegmentFinish || err == ErrSegmentNotActive || err == ErrStaleAttempt {
+				// finished by a split, released by the loop, or replaced by a new attempt
+				return nil
+			}
+			if err != nil {
+				return &Error{Op: "write", URL: request.URL.String(), Begin: offset, End: end, Err: err}
+			}
+			if job.Segment.Finish() {
+				return nil
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				readErr = io.ErrUnexpectedEOF
+			}
+			e := NewRequestError("read", request, offset, end, readErr)
+			e.Retryable = true
+			return e
 		}
 	}
 }
 
 // SingleThreadDownload .
-func (d *Downloader) SingleThreadDownload(request *http.Request, filename string) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("%+v", r)
-		}
-	}()
+func (d *Downloader) SingleThreadDownload(request *http.Request, filename string) error {
+	return d.SingleThreadDownloadContext(context.Background(), request, filename)
+}
+
+// SingleThreadDownloadContext .
+func (d *Downloader) SingleThreadDownloadContext(ctx context.Context, request *http.Request, filename string) (err error) {
+	progress := d.newTracker(filename)
+	defer func() { progress.finish(err) }()
+	return d.singleThreadDownload(ctx, request, filename, d.Checksum, progress)
+}
 
+func (d *Downloader) singleThreadDownload(ctx context.Context, request *http.Request, filename string, checksum *Checksum, progress *tracker) error {
 	logrus.Debugf("Single thread download: %s", request.URL)
 
 	if filename == "" {
 		filename = ExtractFilenameFromURI(request.URL)
 		logrus.Debugf("Get filename %s", filename)
 	}
-	filesize := GetFileSize(filename)
+	filesize, err := GetFileSize(filename)
+	if err != nil {
+		return &Error{Op: "stat", URL: request.URL.String(), Err: err}
+	}
+	stateFilename := filename + ".state"
+	state := NewState(request.URL.String())
+	if b, err := ioutil.ReadFile(stateFilename); err == nil {
+		if state, err = StateReadFromByte(b); errors.Is(err, ErrStateCorrupt) {
+			logrus.Warnf("State file %s is corrupt, restart %s", stateFilename, filename)
+			state, filesize = NewState(request.URL.String()), 0
+		} else if err != nil {
+			return &Error{Op: "parse state", URL: request.URL.String(), Err: err}
+		}
+	}
+	if len(state.URLs) == 0 {
+		state.URLs = []string{request.URL.String()}
+	}
+	if state.Segments.Remaining() > 0 {
+		// a multi thread download preallocates the file, only its contiguous completed prefix is downloaded
+		completed := int64(0)
+		if ranges := state.Segments.Completed(); len(ranges) > 0 && ranges[0].Begin == 0 {
+			completed = ranges[0].End
+		}
+		if completed < filesize {
+			logrus.Infof("Continue %s from %d, the end of its contiguous completed segments", filename, completed)
+			if err = os.Truncate(filename, completed); err != nil {
+				return &Error{Op: "truncate", URL: request.URL.String(), Err: err}
+			}
+			filesize = completed
+		}
+		state.Segments = NewSegments(nil)
+		if err = writeFileAtomic(stateFilename, state.ToByte()); err != nil {
+			return &Error{Op: "write state", URL: request.URL.String(), Err: err}
+		}
+	}
+
+	origin := request
+	request = request.Clone(ctx)
 	SetSuffixRange(request, filesize)
+	if filesize > 0 {
+		if state.Validator.Empty() {
+			logrus.Warnf("No validator in %s, cannot check whether remote file changed", stateFilename)
+		}
+		SetIfRange(request, state.Validator)
+	}
 
 	response, err := d.Client.Do(request)
 	if err != nil {
-		panic(err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return NewRequestError("request", request, filesize, 0, err)
 	}
 	defer response.Body.Close()
 
 	logrus.Debugf("Open file %s", filename)
 	var file *os.File
 	if response.StatusCode == 206 {
-		file, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
-			panic(err)
+		if RemoteChanged(request, response) {
+			return &Error{Op: "request", URL: request.URL.String(), StatusCode: response.StatusCode,
+				Begin: filesize, Retryable: true, Err: ErrRemoteChanged}
+		}
+		flag := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+		if filesize == 0 {
+			flag |= os.O_TRUNC
 		}
+		file, err = os.OpenFile(filename, flag, 0644)
 	} else if 200 <= response.StatusCode && response.StatusCode < 300 {
-		logrus.Warnf("Cannot continue download, uri = %s", request.URL)
-		file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
+		if RemoteChanged(request, response) {
+			logrus.Warnf("Remote file changed since last download, restart %s", filename)
+		} else if filesize > 0 {
+			logrus.Warnf("Cannot continue download, uri = %s", request.URL)
+		}
+		file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		filesize = 0
-		if err != nil {
-			panic(err)
+	} else if length := ContentRangeLength(response); response.StatusCode == http.StatusRequestedRangeNotSatisfiable && length >= 0 {
+		if length == filesize && (state.Validator.Length <= 0 || state.Validator.Length == length) {
+			logrus.Infof("%s is already complete", filename)
+			progress.start(filesize, filesize)
+			if file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+				return &Error{Op: "open", URL: request.URL.String(), Err: err}
+			}
+			file.Close()
+			return verifyFile(filename, checksum)
+		}
+		if filesize == 0 {
+			return NewStatusError("request", response, filesize, 0)
 		}
+		logrus.Warnf("Remote file is %d bytes rather than %d, restart %s", length, filesize, filename)
+		response.Body.Close()
+		os.Remove(stateFilename)
+		if err = os.Truncate(filename, 0); err != nil {
+			return &Error{Op: "truncate", URL: request.URL.String(), Err: err}
+		}
+		return d.singleThreadDownload(ctx, origin, filename, checksum, progress)
 	} else {
-		panic(fmt.Errorf("Request error, code = %d, status = %s", response.StatusCode, response.Status))
+		return NewStatusError("request", response, filesize, 0)
+	}
+	if err != nil {
+		return &Error{Op: "open", URL: request.URL.String(), Err: err}
+	}
+	defer file.Close()
+	if response.ContentLength > 0 {
+		if err = checkSpace(filename, response.ContentLength); err != nil {
+			return &Error{Op: "open", URL: request.URL.String(), Err: err}
+		}
+	}
+
+	if response.StatusCode == 206 || response.Header.Get("Accept-Ranges") == "bytes" {
+		if response.StatusCode != 206 {
+			state.Validator = NewValidator(response, response.ContentLength)
+		} else if state.Validator.Empty() {
+			state.Validator = NewValidator(response, ContentRangeLength(response))
+		}
+		if err = writeFileAtomic(stateFilename, state.ToByte()); err != nil {
+			return &Error{Op: "write state", URL: request.URL.String(), Err: err}
+		}
 	}
 
+	total := int64(-1)
+	if response.ContentLength >= 0 {
+		total = filesize + response.ContentLength
+	}
+	progress.start(filesize, total)
 	writer := &ProgressWriter{
-		Title:   fmt.Sprintf("Write to %s", filename),
-		Dst:     file,
-		Current: filesize,
-		Total:   filesize + response.ContentLength,
+		Title:    fmt.Sprintf("Write to %s", filename),
+		Dst:      file,
+		Current:  filesize,
+		Total:    filesize + response.ContentLength,
+		progress: progress,
 	}
-	copySize, err := CopyWithReadTimeout(writer, response.Body, ReadTimeout)
-	if copySize < response.ContentLength {
-		panic(err)
+	copySize, err := CopyWithReadTimeoutContext(ctx, writer, NewRateLimitedReader(ctx, response.Body, d.rateLimiter()), ReadTimeout)
+	if copySize < response.ContentLength || (response.ContentLength < 0 && err != nil) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return &Error{Op: "write", URL: request.URL.String(), Begin: filesize + copySize, Err: err}
+		}
+		return NewRequestError("read", request, filesize+copySize, 0, err)
 	}
-	return nil
+	file.Close()
+	return verifyFile(filename, checksum)
+}
+
+// verifyFile quarantines the file if checksum mismatches.
+func verifyFile(filename string, checksum *Checksum) error {
+	if checksum == nil {
+		return nil
+	}
+	var checksumErr *ChecksumError
+	err := checksum.VerifyFile(filename)
+	if errors.As(err, &checksumErr) {
+		return Quarantine(filename, checksumErr)
+	}
+	return err
+}
+
+// Quarantine moves the file to .corrupt, without the .part suffix.
+func Quarantine(filename string, checksumErr *ChecksumError) error {
+	corrupt := strings.TrimSuffix(filename, PartSuffix) + ".corrupt"
+	logrus.Errorf("Checksum mismatch, move %s to %s", filename, corrupt)
+	os.Remove(filename + ".state")
+	if err := os.Rename(filename, corrupt); err != nil {
+		logrus.Errorf("Quarantine %s error: %v", filename, err)
+		os.Remove(filename)
+	}
+	return checksumErr
 }
 
 // DetectContinueDownload .
 func (d *Downloader) DetectContinueDownload(req *http.Request) (bool, int64, error) {
-	request := req.Clone(context.Background())
+	return d.DetectContinueDownloadContext(context.Background(), req)
+}
+
+// DetectContinueDownloadContext .
+func (d *Downloader) DetectContinueDownloadContext(ctx context.Context, req *http.Request) (bool, int64, error) {
+	remote, err := d.DetectRemoteContext(ctx, req)
+	if err != nil {
+		return false, 0, err
+	}
+	return remote.Range, remote.Length, nil
+}
+
+// DetectRemoteContext .
+func (d *Downloader) DetectRemoteContext(ctx context.Context, req *http.Request) (*Remote, error) {
+	request := req.Clone(ctx)
 	request.Method = "HEAD"
 	SetSuffixRange(request, 1)
 
 	response, err := d.Client.Do(request)
 	if err != nil {
-		return false, 0, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, NewRequestError("detect", request, 0, 0, err)
 	}
 	defer response.Body.Close()
 	if response.StatusCode == 206 {
-		return true, response.ContentLength + 1, nil
+		length := ContentRangeLength(response)
+		if length < 0 {
+			length = response.ContentLength + 1
+		}
+		return &Remote{Validator: NewValidator(response, length), Range: true, Filename: FilenameFromResponse(response)}, nil
 	} else if 200 <= response.StatusCode && response.StatusCode < 300 {
-		return false, response.ContentLength, nil
+		return &Remote{Validator: NewValidator(response, response.ContentLength), Filename: FilenameFromResponse(response)}, nil
+	} else if length := ContentRangeLength(response); response.StatusCode == http.StatusRequestedRangeNotSatisfiable && length >= 0 {
+		// the file is shorter than the probe range, e.g. empty
+		return &Remote{Validator: NewValidator(response, length), Range: true, Filename: FilenameFromResponse(response)}, nil
 	}
-	return false, 0, fmt.Errorf("Request error: code = %d, status = %s", response.StatusCode, response.Status)
+	return nil, NewStatusError("detect", response, 0, 0)
 }
 
 // FilterUnmatchedHash .
-func (d *Downloader) FilterUnmatchedHash(request *http.Request, filename, maxLenStr, startStr string) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("%+v", r)
-		}
-	}()
-
+func (d *Downloader) FilterUnmatchedHash(request *http.Request, filename, maxLenStr, startStr string) error {
 	maxLen, err := SizeToInt(maxLenStr)
 	if err != nil {
 		return err
@@ -375,31 +1034,36 @@ func (d *Downloader) FilterUnmatchedHash(request *http.Request, filename, maxLen
 	if filename == "" {
 		filename = ExtractFilenameFromURI(request.URL)
 	}
+	// an interrupted download is in the part file, unless it is in place
+	if part := filename + PartSuffix; !exists(filename+".state") && exists(part+".state") {
+		filename = part
+	}
 	logrus.Debugf("Max segment: %d, for file: %s", maxLen, filename)
 
 	file, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "open", URL: request.URL.String(), Err: err}
 	}
 	defer file.Close()
 
 	stateFile, err := os.OpenFile(filename+".state", os.O_RDWR, 0755)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "open state", URL: request.URL.String(), Err: err}
 	}
 	defer stateFile.Close()
-	state, err := ioutil.ReadAll(stateFile)
+	b, err := ioutil.ReadAll(stateFile)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "read state", URL: request.URL.String(), Err: err}
 	}
-	segments, err := SegmentsReadFromByte(state)
+	state, err := StateReadFromByte(b)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "parse state", URL: request.URL.String(), Err: err}
 	}
+	segments := state.Segments
 
 	saveSegments := func() {
-		b := segments.ToByte()
-		fmt.Printf("Segments: %s\n", string(b))
+		b := state.ToByte()
+		fmt.Printf("Segments: %s\n", segments)
 		stateFile.Truncate(0)
 		stateFile.WriteAt(b, 0)
 	}
@@ -413,8 +1077,11 @@ func (d *Downloader) FilterUnmatchedHash(request *http.Request, filename, maxLen
 	}
 
 	canContinue, size, err := d.DetectContinueDownload(request)
-	if !canContinue || err != nil {
-		panic(fmt.Errorf("Can't get part of content, %v", err))
+	if err != nil {
+		return err
+	}
+	if !canContinue {
+		return &Error{Op: "detect", URL: request.URL.String(), Err: ErrUnsupport206}
 	}
 
 	segments.InitSize(size)
@@ -423,17 +1090,19 @@ func (d *Downloader) FilterUnmatchedHash(request *http.Request, filename, maxLen
 		if end > size {
 			end = size
 		}
-		d.FilterUnmatchedHashSegments(request, file, begin, end, segments)
+		if err = d.FilterUnmatchedHashSegments(request, file, begin, end, segments); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 // FilterUnmatchedHashSegments .
-func (d *Downloader) FilterUnmatchedHashSegments(req *http.Request, src io.ReaderAt, begin, end int64, segments *Segments) {
+func (d *Downloader) FilterUnmatchedHashSegments(req *http.Request, src io.ReaderAt, begin, end int64, segments *Segments) error {
 	hash1, err := filehash.HashFile(src, begin, end)
 	if err != nil {
-		panic(err)
+		return &Error{Op: "hash", URL: req.URL.String(), Begin: begin, End: end, Err: err}
 	}
 
 	SetRange(req, begin, end-1)
@@ -445,34 +1114,37 @@ func (d *Downloader) FilterUnmatchedHashSegments(req *http.Request, src io.Reade
 
 	response, err := d.Client.Do(req)
 	if err != nil {
-		panic(err)
+		return NewRequestError("hash", req, begin, end, err)
 	}
 	defer response.Body.Close()
 
-	if 200 <= response.StatusCode && response.StatusCode < 300 {
-		hash2, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			panic(err)
-		}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return NewStatusError("hash", response, begin, end)
+	}
 
-		equals := (hex.EncodeToString(hash1) == strings.TrimSpace(string(hash2)))
-		equalsStr := "!="
-		if equals {
-			equalsStr = "=="
-		}
+	hash2, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return NewRequestError("hash", req, begin, end, err)
+	}
 
-		logrus.Debugf("Calc hash: %s - %s, %x %s %s", SizeToReadable(float64(begin)), SizeToReadable(float64(end)),
-			hash1, equalsStr, string(hash2))
-		if !equals {
-			if end-begin <= 2*MinimalSegment {
-				segments.Remove(begin, end)
-			} else {
-				mid := begin + (end-begin)/2
-				d.FilterUnmatchedHashSegments(req, src, begin, mid, segments)
-				d.FilterUnmatchedHashSegments(req, src, mid, end, segments)
+	equals := (hex.EncodeToString(hash1) == strings.TrimSpace(string(hash2)))
+	equalsStr := "!="
+	if equals {
+		equalsStr = "=="
+	}
+
+	logrus.Debugf("Calc hash: %s - %s, %x %s %s", SizeToReadable(float64(begin)), SizeToReadable(float64(end)),
+		hash1, equalsStr, string(hash2))
+	if !equals {
+		if end-begin <= 2*MinimalSegment {
+			segments.Remove(begin, end)
+		} else {
+			mid := begin + (end-begin)/2
+			if err = d.FilterUnmatchedHashSegments(req, src, begin, mid, segments); err != nil {
+				return err
 			}
+			return d.FilterUnmatchedHashSegments(req, src, mid, end, segments)
 		}
-	} else {
-		panic(fmt.Errorf("Request error, code = %d, status = %s", response.StatusCode, response.Status))
 	}
+	return nil
 }
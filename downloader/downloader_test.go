@@ -2,12 +2,18 @@ package downloader
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -111,3 +117,270 @@ func TestMultiThreadDownload(t *testing.T) {
 		t.Error("Copy error")
 	}
 }
+
+type slowResponseWriter struct {
+	http.ResponseWriter
+	delay time.Duration
+}
+
+func (w *slowResponseWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestMultiThreadDownloadCancel(t *testing.T) {
+	size := int64(1024 * 1024)
+	src := make([]byte, size)
+	rand.Read(src)
+	dst := &WriteAtBuffer{buffer: make([]byte, size)}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(&slowResponseWriter{w, 50 * time.Millisecond}, r, "test", time.Now(), bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	segs := NewSegments(nil)
+	begin := time.Now()
+	err := NewDefaultDownloader().MultiThreadDownloadContext(ctx, request, segs, dst, "test", size, 4)
+	if err != context.Canceled {
+		t.Errorf("Expect %v, got %v", context.Canceled, err)
+	}
+	if time.Since(begin) > 2*time.Second {
+		t.Errorf("Cancel takes too long: %v", time.Since(begin))
+	}
+	if segs.Remaining() == 0 {
+		t.Error("Download should not finish after cancel")
+	}
+}
+
+func TestMultiThreadDownloadUnsupport206(t *testing.T) {
+	size := int64(1024 * 1024)
+	src := make([]byte, size)
+	dst := &WriteAtBuffer{buffer: make([]byte, size)}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	err := NewDefaultDownloader().MultiThreadDownload(request, NewSegments(nil), dst, "test", size, 4)
+	if !errors.Is(err, ErrUnsupport206) {
+		t.Errorf("Expect %v, got %v", ErrUnsupport206, err)
+	}
+	if IsRetryable(err) {
+		t.Errorf("Error should not be retryable: %v", err)
+	}
+
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != 200 || e.URL == "" {
+		t.Errorf("Unexpected error detail: %#v", err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	cases := []struct {
+		code      int
+		err       error
+		retryable bool
+	}{
+		{401, ErrUnauthorized, false},
+		{403, ErrForbidden, false},
+		{404, ErrNotFound, false},
+		{429, ErrTooManyRequests, true},
+		{503, ErrServerError, true},
+		{418, ErrUnexpectedStatus, false},
+	}
+	for _, c := range cases {
+		code := c.code
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		err := NewDefaultDownloader().DownloadFile(request, 4, "test")
+		if !errors.Is(err, c.err) {
+			t.Errorf("Code %d: expect %v, got %v", c.code, c.err, err)
+		}
+		if IsRetryable(err) != c.retryable {
+			t.Errorf("Code %d: expect retryable %v, got %v", c.code, c.retryable, err)
+		}
+		server.Close()
+	}
+}
+
+// newTestFile returns random content of size, and the filename of name in a temp dir which is removed by cleanup,
+// an empty name returns the dir.
+func newTestFile(t *testing.T, size int64, name string) ([]byte, string, func()) {
+	src := make([]byte, size)
+	rand.Read(src)
+	dir, err := ioutil.TempDir("", "gget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src, filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
+
+func newETagServer(src []byte, etag func(r *http.Request) string) *httptest.Server {
+	modTime := time.Now().Add(-time.Hour)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag(r))
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+}
+
+func TestDownloadFileRemoteChanged(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+
+	for _, thread := range []int{1, 4} {
+		stale := make([]byte, size/2)
+		rand.Read(stale)
+		state := &State{
+			Validator: Validator{ETag: `"v1"`, Length: size},
+			Segments:  NewSegments([]*Segment{{begin: 0, position: size / 2, end: size}}),
+		}
+		ioutil.WriteFile(filename, stale, 0644)
+		ioutil.WriteFile(filename+".state", state.ToByte(), 0644)
+
+		server := newETagServer(src, func(r *http.Request) string { return `"v2"` })
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		err := NewDefaultDownloader().DownloadFile(request, thread, filename)
+		server.Close()
+		if err != nil {
+			t.Errorf("Thread %d: %v", thread, err)
+		}
+
+		b, _ := ioutil.ReadFile(filename)
+		if !bytes.Equal(src, b) {
+			t.Errorf("Thread %d: content mismatch after remote changed", thread)
+		}
+	}
+}
+
+func TestMultiThreadDownloadChangedDuringDownload(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+
+	server := newETagServer(src, func(r *http.Request) string {
+		if r.Method == "HEAD" {
+			return `"v1"`
+		}
+		return `"v2"`
+	})
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	err := NewDefaultDownloader().DownloadFile(request, 4, filename)
+	if !errors.Is(err, ErrRemoteChanged) {
+		t.Errorf("Expect %v, got %v", ErrRemoteChanged, err)
+	}
+}
+
+func TestRangeNotSatisfiable(t *testing.T) {
+	size := int64(1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+
+	var gets int32
+	server := newETagServer(src, func(r *http.Request) string {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		return `"v1"`
+	})
+	defer server.Close()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+
+	// complete file is not downloaded again
+	ioutil.WriteFile(filename, src, 0644)
+	if err := NewDefaultDownloader().DownloadFile(request, 1, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+
+	// local file longer than remote restarts
+	ioutil.WriteFile(filename, append(src, src...), 0644)
+	if err := NewDefaultDownloader().DownloadFile(request, 1, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch after restart")
+	}
+	if gets != 3 {
+		t.Errorf("Expect 3 requests, got %d", gets)
+	}
+
+	// empty remote file
+	empty := newETagServer(nil, func(r *http.Request) string { return `"empty"` })
+	defer empty.Close()
+	for _, thread := range []int{1, 4} {
+		os.Remove(filename)
+		os.Remove(filename + ".state")
+		request, _ = http.NewRequest("GET", empty.URL, nil)
+		if err := NewDefaultDownloader().DownloadFile(request, thread, filename); err != nil {
+			t.Fatalf("Thread %d: %v", thread, err)
+		}
+		if info, err := os.Stat(filename); err != nil || info.Size() != 0 {
+			t.Errorf("Thread %d: expect empty file, got %v", thread, err)
+		}
+	}
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	_, filename, cleanup := newTestFile(t, 0, "file")
+	defer cleanup()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	err := NewDefaultDownloader().DownloadFile(request, 1, filename)
+	if !errors.Is(err, ErrServiceUnavailable) || !errors.Is(err, ErrServerError) || !IsRetryable(err) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if RetryAfter(err) != 7*time.Second {
+		t.Errorf("Expect Retry-After 7s, got %s", RetryAfter(err))
+	}
+}
+
+func BenchmarkMultiThreadDownload(b *testing.B) {
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	size := int64(64 * 1024 * 1024)
+	src := make([]byte, size)
+	rand.Read(src)
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+	f, err := ioutil.TempFile("", "gget")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, thread := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("%d", thread), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				request, _ := http.NewRequest("GET", server.URL, nil)
+				err := NewDefaultDownloader().MultiThreadDownloadContext(context.Background(), request, NewSegments(nil), f, "bench", size, thread)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !plan9
+// +build !plan9
+
+package downloader
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnReset reports whether the connection is reset by the peer.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// isNoSpace reports whether the device has no space left.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
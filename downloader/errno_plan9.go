@@ -0,0 +1,11 @@
+package downloader
+
+// plan9 has no errno, a reset connection and a full disk are not recognized.
+
+func isConnReset(err error) bool {
+	return false
+}
+
+func isNoSpace(err error) bool {
+	return false
+}
@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrUnauthorized        = errors.New("Unauthorized")
+	ErrForbidden           = errors.New("Forbidden")
+	ErrNotFound            = errors.New("Not Found")
+	ErrRangeNotSatisfiable = errors.New("Range Not Satisfiable")
+	ErrTooManyRequests     = errors.New("Too Many Requests")
+	ErrServerError         = errors.New("Server Error")
+	ErrServiceUnavailable  = errors.New("Service Unavailable")
+	ErrUnexpectedStatus    = errors.New("Unexpected Status")
+	ErrDiskFull            = errors.New("Disk Full")
+)
+
+// Error .
+type Error struct {
+	Op         string
+	URL        string
+	StatusCode int
+	Begin      int64
+	End        int64
+	Retryable  bool
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *Error) Error() string {
+	buffer := bytes.NewBufferString(e.Op)
+	if e.URL != "" {
+		fmt.Fprintf(buffer, " %s", e.URL)
+	}
+	if e.StatusCode != 0 {
+		fmt.Fprintf(buffer, ", code = %d", e.StatusCode)
+	}
+	if e.End > 0 {
+		fmt.Fprintf(buffer, ", range = %d-%d", e.Begin, e.End-1)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(buffer, ": %v", e.Err)
+	}
+	return buffer.String()
+}
+
+// Unwrap .
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is .
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrDiskFull:
+		return isNoSpace(e.Err)
+	case ErrServerError:
+		return e.Err == ErrServiceUnavailable
+	}
+	return false
+}
+
+// IsRetryable .
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrDiskFull) {
+		// retries cannot free space
+		return false
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Retryable
+	}
+	var checksumErr *ChecksumError
+	if errors.As(err, &checksumErr) {
+		return len(checksumErr.Suspect) > 0
+	}
+	return errors.Is(err, ErrReadTimeout)
+}
+
+// NewStatusError .
+func NewStatusError(op string, response *http.Response, begin, end int64) *Error {
+	e := &Error{
+		Op:         op,
+		StatusCode: response.StatusCode,
+		Begin:      begin,
+		End:        end,
+		Err:        ErrUnexpectedStatus,
+	}
+	if response.Request != nil {
+		e.URL = response.Request.URL.String()
+	}
+	e.RetryAfter = ParseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+
+	switch code := response.StatusCode; {
+	case code == http.StatusUnauthorized:
+		e.Err = ErrUnauthorized
+	case code == http.StatusForbidden:
+		e.Err = ErrForbidden
+	case code == http.StatusNotFound:
+		e.Err = ErrNotFound
+	case code == http.StatusRequestedRangeNotSatisfiable:
+		e.Err = ErrRangeNotSatisfiable
+	case code == http.StatusTooManyRequests:
+		e.Err = ErrTooManyRequests
+		e.Retryable = true
+	case code == http.StatusRequestTimeout:
+		e.Retryable = true
+	case code == http.StatusServiceUnavailable:
+		e.Err = ErrServiceUnavailable
+		e.Retryable = true
+	case code >= 500:
+		e.Err = ErrServerError
+		e.Retryable = true
+	case 200 <= code && code < 300 && end > 0:
+		e.Err = ErrUnsupport206
+	}
+	return e
+}
+
+// NewRequestError .
+func NewRequestError(op string, request *http.Request, begin, end int64, err error) *Error {
+	e := &Error{
+		Op:    op,
+		URL:   request.URL.String(),
+		Begin: begin,
+		End:   end,
+		Err:   err,
+	}
+
+	inner := err
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		inner = urlErr.Err
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+	case errors.Is(inner, ErrReadTimeout) || errors.Is(inner, io.ErrUnexpectedEOF) || errors.Is(inner, io.EOF):
+		e.Retryable = true
+	case errors.As(inner, &netErr) || isConnReset(inner):
+		e.Retryable = true
+	}
+	return e
+}
@@ -0,0 +1,182 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobStaleAttempt(t *testing.T) {
+	size := int64(MinimalSegment)
+	src := make([]byte, size)
+	rand.Read(src)
+	stalled, release := make(chan struct{}), make(chan struct{})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// the first attempt stalls, then delivers garbage after it is replaced
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", size-1, size))
+			w.WriteHeader(http.StatusPartialContent)
+			w.(http.Flusher).Flush()
+			close(stalled)
+			<-release
+			w.Write(make([]byte, size))
+			return
+		}
+		http.ServeContent(w, r, "test", time.Now(), bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	dst := &WriteAtBuffer{buffer: make([]byte, size)}
+	segments := NewSegments(nil)
+	segments.InitSize(size)
+	jobs := make([]*Job, 1)
+	d := NewDefaultDownloader()
+	if err := d.CreateNewJob(segments, jobs, 0, dst); err != nil {
+		t.Fatal(err)
+	}
+	job := jobs[0]
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	results := make(chan *result, 2)
+	go d.StartJobContext(context.Background(), request, job, results)
+	<-stalled
+	stale := job.attempt
+
+	d.StartJobContext(context.Background(), request, job, results)
+	if res := <-results; res.attempt != job.attempt || res.err != nil {
+		t.Fatalf("Expect result of the new attempt, got attempt %d, err %v", res.attempt, res.err)
+	}
+	close(release)
+	if res := <-results; res.attempt != stale {
+		t.Errorf("Expect result of the stale attempt, got %d", res.attempt)
+	}
+	if !bytes.Equal(dst.Bytes(), src) {
+		t.Error("Stale attempt overwrites data")
+	}
+}
+
+// faultHandler serves the content with random faults of GET requests.
+type faultHandler struct {
+	src     []byte
+	modTime time.Time
+
+	mutex  sync.Mutex
+	rand   *rand.Rand
+	stalls int
+	faults map[string]int
+}
+
+func (h *faultHandler) fault() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fault := ""
+	switch n := h.rand.Intn(10); {
+	case n == 0:
+		fault = "truncate"
+	case n == 1:
+		fault = "unavailable"
+	case n == 2:
+		fault = "reset"
+	case n == 3:
+		fault = "slow"
+	case n == 4 && h.stalls < 2:
+		h.stalls++
+		fault = "stall"
+	}
+	h.faults[fault]++
+	return fault
+}
+
+func (h *faultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fault := ""
+	if r.Method == "GET" {
+		fault = h.fault()
+	}
+	switch fault {
+	case "truncate":
+		w = &truncatedResponseWriter{ResponseWriter: w, left: 1000 + rand.Intn(100000)}
+	case "unavailable":
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	case "reset":
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+		return
+	case "slow":
+		w = &slowResponseWriter{w, 5 * time.Millisecond}
+	case "stall":
+		// longer than read timeout, the job is restarted while this response continues
+		w = &stallResponseWriter{ResponseWriter: w, delay: 2500 * time.Millisecond}
+	}
+	http.ServeContent(w, r, "test", h.modTime, bytes.NewReader(h.src))
+}
+
+type stallResponseWriter struct {
+	http.ResponseWriter
+	delay   time.Duration
+	stalled bool
+}
+
+func (w *stallResponseWriter) Write(b []byte) (int, error) {
+	if !w.stalled && len(b) > 0 {
+		w.stalled = true
+		n, err := w.ResponseWriter.Write(b[:len(b)/2])
+		w.ResponseWriter.(http.Flusher).Flush()
+		time.Sleep(w.delay)
+		if err != nil {
+			return n, err
+		}
+		m, err := w.ResponseWriter.Write(b[n:])
+		return n + m, err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func TestMultiThreadDownloadFaults(t *testing.T) {
+	timeout, segment := ReadTimeout, MinimalSegment
+	ReadTimeout, MinimalSegment = time.Second, 64*1024
+	defer func() { ReadTimeout, MinimalSegment = timeout, segment }()
+
+	size := int64(4 * 1024 * 1024)
+	src := make([]byte, size)
+	rand.Read(src)
+	for _, adaptive := range []bool{false, true} {
+		h := &faultHandler{src: src, modTime: time.Now().Add(-time.Hour), rand: rand.New(rand.NewSource(1)), faults: map[string]int{}}
+		server := httptest.NewServer(h)
+
+		f, err := ioutil.TempFile("", "gget")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDefaultDownloader()
+		d.Adaptive = adaptive
+		d.Retry = &RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, Multiplier: 2}
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		err = d.MultiThreadDownloadContext(context.Background(), request, NewSegments(nil), f, "test-faults", size, 8)
+		b, _ := ioutil.ReadFile(f.Name())
+		f.Close()
+		os.Remove(f.Name())
+		server.Close()
+
+		if err != nil {
+			t.Fatalf("Adaptive %v: %v", adaptive, err)
+		}
+		if !bytes.Equal(b, src) {
+			t.Errorf("Adaptive %v: content mismatch", adaptive)
+		}
+		h.mutex.Lock()
+		t.Logf("Adaptive %v: faults %v", adaptive, h.faults)
+		h.mutex.Unlock()
+	}
+}
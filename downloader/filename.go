@@ -0,0 +1,67 @@
+package downloader
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	DefaultFilename = "index.html"
+	MaxFilename     = 255
+)
+
+// FilenameFromResponse returns the filename from Content-Disposition, or the url after redirects.
+func FilenameFromResponse(response *http.Response) string {
+	if disposition := response.Header.Get("Content-Disposition"); disposition != "" {
+		// mime decodes RFC 5987 filename* into filename, and prefers it
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			if name := SanitizeFilename(params["filename"]); name != "" {
+				return name
+			}
+		}
+	}
+	if response.Request != nil {
+		return ExtractFilenameFromURI(response.Request.URL)
+	}
+	return DefaultFilename
+}
+
+// ExtractFilenameFromURI returns the last path segment of uri, or DefaultFilename for a directory.
+func ExtractFilenameFromURI(uri *url.URL) string {
+	if uri.Path == "" || strings.HasSuffix(uri.Path, "/") {
+		return DefaultFilename
+	}
+	if name := SanitizeFilename(path.Base(uri.Path)); name != "" {
+		return name
+	}
+	return DefaultFilename
+}
+
+// SanitizeFilename keeps the base name only, and removes control characters, it returns empty if nothing left.
+func SanitizeFilename(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	if index := strings.LastIndex(name, "/"); index >= 0 {
+		name = name[index+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+	if len(name) > MaxFilename {
+		ext := path.Ext(name)
+		if len(ext) >= MaxFilename/2 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:MaxFilename-len(ext)], "") + ext
+	}
+	return name
+}
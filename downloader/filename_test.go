@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilenameFromResponse(t *testing.T) {
+	cases := []struct {
+		disposition string
+		uri         string
+		filename    string
+	}{
+		{`attachment; filename="report.pdf"`, "http://host/download?id=5", "report.pdf"},
+		{`attachment; filename="fallback.txt"; filename*=UTF-8''%E6%96%87%E4%BB%B6.txt`, "http://host/download", "文件.txt"},
+		{`attachment; filename="../../etc/passwd"`, "http://host/download", "passwd"},
+		{`attachment; filename="..\\..\\boot.ini"`, "http://host/download", "boot.ini"},
+		{"attachment; filename=\"a\x01b.txt\"", "http://host/download", "ab.txt"},
+		{`attachment; filename=".."`, "http://host/dir/file.iso", "file.iso"},
+		{"", "http://host/dir/file%20name.iso?x=1", "file name.iso"},
+		{"", "http://host/dir/", "index.html"},
+		{"", "http://host", "index.html"},
+		{"", "http://host/%2e%2e", "index.html"},
+	}
+	for _, c := range cases {
+		uri, _ := url.Parse(c.uri)
+		response := &http.Response{Header: http.Header{}, Request: &http.Request{URL: uri}}
+		if c.disposition != "" {
+			response.Header.Set("Content-Disposition", c.disposition)
+		}
+		if filename := FilenameFromResponse(response); filename != c.filename {
+			t.Errorf("%q %s: expect %q, got %q", c.disposition, c.uri, c.filename, filename)
+		}
+	}
+
+	long := strings.Repeat("a", 300) + ".tar.gz"
+	if filename := SanitizeFilename(long); len(filename) != MaxFilename || !strings.HasSuffix(filename, ".gz") {
+		t.Errorf("Unexpected long filename %q", filename)
+	}
+}
+
+func TestDownloadFileRedirectFilename(t *testing.T) {
+	src := []byte("content")
+	modTime := time.Now().Add(-time.Hour)
+	filename := "real.bin"
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".state")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/"+filename, http.StatusFound)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, thread := range []int{1, 4} {
+		os.Remove(filename)
+		request, _ := http.NewRequest("GET", server.URL+"/download?id=5", nil)
+		if err := NewDefaultDownloader().DownloadFile(request, thread, ""); err != nil {
+			t.Fatalf("Thread %d: %v", thread, err)
+		}
+		if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+			t.Errorf("Thread %d: content mismatch", thread)
+		}
+	}
+}
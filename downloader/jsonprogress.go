@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// JSONProgress writes one json object per line for every progress tick, and a summary when a download ends.
+type JSONProgress struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+type jsonTick struct {
+	Type        string  `json:"type"`
+	File        string  `json:"file"`
+	Done        int64   `json:"done"`
+	Total       int64   `json:"total"`
+	Speed       float64 `json:"speed"`
+	ETA         float64 `json:"eta"`
+	Connections int     `json:"connections"`
+	Retries     int     `json:"retries"`
+}
+
+type jsonSummary struct {
+	Type         string  `json:"type"`
+	File         string  `json:"file"`
+	Status       string  `json:"status"`
+	Done         int64   `json:"done"`
+	Total        int64   `json:"total"`
+	Elapsed      float64 `json:"elapsed"`
+	AverageSpeed float64 `json:"average_speed"`
+	Retries      int     `json:"retries"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// NewJSONProgress .
+func NewJSONProgress(w io.Writer) *JSONProgress {
+	return &JSONProgress{encoder: json.NewEncoder(w)}
+}
+
+// OnEvent .
+func (p *JSONProgress) OnEvent(event Event) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch event.Type {
+	case EventStarted, EventResumed, EventProgress:
+		eta := float64(-1)
+		if event.ETA >= 0 {
+			eta = event.ETA.Seconds()
+		}
+		p.encoder.Encode(&jsonTick{
+			Type:        event.Type.String(),
+			File:        event.Filename,
+			Done:        event.Done,
+			Total:       event.Total,
+			Speed:       event.Speed,
+			ETA:         eta,
+			Connections: event.Connections,
+			Retries:     event.Retries,
+		})
+	case EventFinished, EventFailed:
+		summary := &jsonSummary{
+			Type:    "summary",
+			File:    event.Filename,
+			Status:  event.Type.String(),
+			Done:    event.Done,
+			Total:   event.Total,
+			Elapsed: event.Elapsed.Seconds(),
+			Retries: event.Retries,
+		}
+		if event.Elapsed > 0 {
+			summary.AverageSpeed = float64(event.Done) / event.Elapsed.Seconds()
+		}
+		if event.Err != nil {
+			summary.Error = event.Err.Error()
+		}
+		p.encoder.Encode(summary)
+	}
+}
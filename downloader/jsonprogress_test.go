@@ -0,0 +1,46 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONProgress(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+
+	buffer := &bytes.Buffer{}
+	d := NewDefaultDownloader()
+	d.Observer = NewJSONProgress(buffer)
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := d.DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Expect ticks and summary, got %q", buffer.String())
+	}
+	tick := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &tick); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"done", "total", "speed", "eta", "connections", "retries"} {
+		if _, ok := tick[key]; !ok {
+			t.Errorf("Missing %s in tick %s", key, lines[0])
+		}
+	}
+	summary := &jsonSummary{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Type != "summary" || summary.Status != "finished" || summary.Done != size || summary.Total != size {
+		t.Errorf("Unexpected summary %s", lines[len(lines)-1])
+	}
+}
@@ -0,0 +1,285 @@
+package downloader
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrWrongMetalinkFormat = errors.New("Wrong Metalink Format")
+	ErrRelativeMetalinkURL = errors.New("Relative Metalink URL")
+
+	MaxMetalinkFile = int64(16 * 1024 * 1024)
+)
+
+// Metalink .
+type Metalink struct {
+	Files []*MetalinkFile
+}
+
+// MetalinkFile .
+type MetalinkFile struct {
+	Name     string
+	Size     int64
+	URLs     []MetalinkURL
+	Checksum *Checksum
+	Pieces   *Pieces
+}
+
+// MetalinkURL .
+type MetalinkURL struct {
+	URL      string
+	Priority int
+}
+
+type metalinkXML struct {
+	XMLName xml.Name          `xml:"metalink"`
+	Files   []metalinkFileXML `xml:"file"`
+	Files3  []metalinkFileXML `xml:"files>file"`
+}
+
+type metalinkFileXML struct {
+	Name         string          `xml:"name,attr"`
+	Size         int64           `xml:"size"`
+	Hashes       []metalinkHash  `xml:"hash"`
+	Pieces       []metalinkPiece `xml:"pieces"`
+	URLs         []metalinkURL   `xml:"url"`
+	Verification struct {
+		Hashes []metalinkHash  `xml:"hash"`
+		Pieces []metalinkPiece `xml:"pieces"`
+	} `xml:"verification"`
+	Resources struct {
+		URLs []metalinkURL `xml:"url"`
+	} `xml:"resources"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Piece int    `xml:"piece,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPiece struct {
+	Length int64          `xml:"length,attr"`
+	Type   string         `xml:"type,attr"`
+	Hashes []metalinkHash `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Priority   int    `xml:"priority,attr"`
+	Preference int    `xml:"preference,attr"`
+	URL        string `xml:",chardata"`
+}
+
+// IsMetalink .
+func IsMetalink(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".meta4" || ext == ".metalink"
+}
+
+// ParseMetalink parses RFC 5854 metalink (.meta4) and metalink 3 (.metalink) documents.
+func ParseMetalink(b []byte) (*Metalink, error) {
+	doc := &metalinkXML{}
+	if err := xml.Unmarshal(b, doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrongMetalinkFormat, err)
+	}
+
+	m := &Metalink{}
+	for _, f := range append(doc.Files, doc.Files3...) {
+		file := &MetalinkFile{Name: f.Name, Size: f.Size}
+		for _, u := range append(f.URLs, f.Resources.URLs...) {
+			uri := strings.TrimSpace(u.URL)
+			// relative urls are kept to be resolved against the metalink url
+			if parsed, err := url.Parse(uri); err != nil || uri == "" || parsed.Scheme != "" && !isHTTP(parsed) {
+				continue
+			}
+			priority := u.Priority
+			if priority == 0 && u.Preference > 0 {
+				// metalink 3 preference is 1 - 100, higher is better
+				priority = 101 - u.Preference
+			}
+			if priority == 0 {
+				priority = 999999
+			}
+			file.URLs = append(file.URLs, MetalinkURL{URL: uri, Priority: priority})
+		}
+		sort.SliceStable(file.URLs, func(i, j int) bool {
+			return file.URLs[i].Priority < file.URLs[j].Priority
+		})
+
+		file.Checksum = strongestChecksum(append(f.Hashes, f.Verification.Hashes...))
+		file.Pieces = strongestPieces(append(f.Pieces, f.Verification.Pieces...))
+		if file.Name == "" || len(file.URLs) == 0 {
+			logrus.Warnf("Skip metalink file %q without name or url", file.Name)
+			continue
+		}
+		m.Files = append(m.Files, file)
+	}
+	if len(m.Files) == 0 {
+		return nil, fmt.Errorf("%w: no file", ErrWrongMetalinkFormat)
+	}
+	return m, nil
+}
+
+func isHTTP(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// Resolve resolves relative urls against base and drops the urls which are not http, along with the files left without url.
+// Relative urls are rejected if base is nil, as in a local metalink file.
+func (m *Metalink) Resolve(base *url.URL) error {
+	files := m.Files[:0]
+	for _, file := range m.Files {
+		urls := file.URLs[:0]
+		for _, u := range file.URLs {
+			uri, err := url.Parse(u.URL)
+			if err != nil {
+				continue
+			}
+			if !uri.IsAbs() {
+				if base == nil {
+					return fmt.Errorf("%w: %s", ErrRelativeMetalinkURL, u.URL)
+				}
+				uri = base.ResolveReference(uri)
+			}
+			if isHTTP(uri) {
+				u.URL = uri.String()
+				urls = append(urls, u)
+			}
+		}
+		if file.URLs = urls; len(urls) == 0 {
+			logrus.Warnf("Skip metalink file %q without http url", file.Name)
+			continue
+		}
+		files = append(files, file)
+	}
+	if m.Files = files; len(files) == 0 {
+		return fmt.Errorf("%w: no file", ErrWrongMetalinkFormat)
+	}
+	return nil
+}
+
+func normalizeHashType(t string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(t)), "-", "", -1)
+}
+
+func strongestChecksum(hashes []metalinkHash) *Checksum {
+	for _, algo := range ChecksumAlgorithms {
+		for _, h := range hashes {
+			if normalizeHashType(h.Type) != algo {
+				continue
+			}
+			if checksum, err := NewChecksum(algo, h.Value); err == nil {
+				return checksum
+			}
+		}
+	}
+	return nil
+}
+
+func strongestPieces(pieces []metalinkPiece) *Pieces {
+	for _, algo := range ChecksumAlgorithms {
+		for _, p := range pieces {
+			if normalizeHashType(p.Type) != algo {
+				continue
+			}
+			hashes := make([][]byte, 0, len(p.Hashes))
+			for _, h := range p.Hashes {
+				b, err := hex.DecodeString(strings.TrimSpace(h.Value))
+				if err != nil {
+					hashes = nil
+					break
+				}
+				hashes = append(hashes, b)
+			}
+			if pieces, err := NewPieces(algo, p.Length, hashes); err == nil && len(hashes) > 0 {
+				return pieces
+			}
+		}
+	}
+	return nil
+}
+
+// Filename returns the base name of metalink file, ignoring any directory in it.
+func (f *MetalinkFile) Filename() string {
+	return SanitizeFilename(f.Name)
+}
+
+// FetchMetalink .
+func (d *Downloader) FetchMetalink(req *http.Request) (*Metalink, error) {
+	return d.FetchMetalinkContext(context.Background(), req)
+}
+
+// FetchMetalinkContext .
+func (d *Downloader) FetchMetalinkContext(ctx context.Context, req *http.Request) (*Metalink, error) {
+	request := req.Clone(ctx)
+	request.Header.Set("Accept", "application/metalink4+xml, application/metalink+xml, */*")
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return nil, NewRequestError("metalink", request, 0, 0, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, NewStatusError("metalink", response, 0, 0)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(response.Body, MaxMetalinkFile))
+	if err != nil {
+		return nil, NewRequestError("metalink", request, 0, 0, err)
+	}
+	m, err := ParseMetalink(b)
+	if err != nil {
+		return nil, err
+	}
+	// relative urls are resolved against the metalink url after redirects
+	if err = m.Resolve(response.Request.URL); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DownloadMetalinkFile .
+func (d *Downloader) DownloadMetalinkFile(template *http.Request, file *MetalinkFile, threadCount int, filename string) error {
+	return d.DownloadMetalinkFileContext(context.Background(), template, file, threadCount, filename)
+}
+
+// DownloadMetalinkFileContext downloads a metalink file from its mirrors, the header of template request is used for
+// every mirror. Credentials, the Authorization and Cookie headers, are only sent to mirrors on the host of template.
+func (d *Downloader) DownloadMetalinkFileContext(ctx context.Context, template *http.Request, file *MetalinkFile, threadCount int, filename string) error {
+	t := &task{filename: filename, threadCount: threadCount, size: file.Size, checksum: file.Checksum, pieces: file.Pieces}
+	if filename == "" && file.Filename() != "" {
+		t.filename = filepath.Join(d.Directory, file.Filename())
+	}
+	if d.Checksum != nil {
+		t.checksum = d.Checksum
+	}
+	for _, u := range file.URLs {
+		uri, err := url.Parse(u.URL)
+		if err != nil {
+			logrus.Warnf("Skip metalink url %s: %v", u.URL, err)
+			continue
+		}
+		request := template.Clone(ctx)
+		request.URL, request.Host = uri, ""
+		if uri.Host != template.URL.Host {
+			request.Header.Del("Authorization")
+			request.Header.Del("Cookie")
+		}
+		t.requests = append(t.requests, request)
+		t.priorities = append(t.priorities, u.Priority)
+	}
+	return d.download(ctx, t)
+}
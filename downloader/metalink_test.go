@@ -0,0 +1,233 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseMetalink(t *testing.T) {
+	meta4 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="dir/example.iso">
+    <size>12</size>
+    <hash type="md5">6f5902ac237024bdd0c176cb93063dc4</hash>
+    <hash type="sha-256">9c56cc51b374c3ba189210d5b6d4bf57790d351c96c47c02190ecf1e430635ab</hash>
+    <pieces length="8" type="sha-1">
+      <hash>da39a3ee5e6b4b0d3255bfef95601890afd80709</hash>
+      <hash>da39a3ee5e6b4b0d3255bfef95601890afd80709</hash>
+    </pieces>
+    <url priority="2">http://b.example.com/example.iso</url>
+    <url priority="1">https://a.example.com/example.iso</url>
+    <url>ftp://c.example.com/example.iso</url>
+  </file>
+</metalink>`
+	m, err := ParseMetalink([]byte(meta4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 1 {
+		t.Fatalf("Expect 1 file, got %d", len(m.Files))
+	}
+	file := m.Files[0]
+	if file.Name != "dir/example.iso" || file.Filename() != "example.iso" || file.Size != 12 {
+		t.Errorf("Unexpected file %+v", file)
+	}
+	if len(file.URLs) != 2 || file.URLs[0].URL != "https://a.example.com/example.iso" || file.URLs[1].Priority != 2 {
+		t.Errorf("Unexpected urls %+v", file.URLs)
+	}
+	if file.Checksum == nil || file.Checksum.Algorithm != "sha256" {
+		t.Errorf("Expect sha256 checksum, got %+v", file.Checksum)
+	}
+	if file.Pieces == nil || file.Pieces.Algorithm != "sha1" || file.Pieces.Length != 8 || len(file.Pieces.Hashes) != 2 {
+		t.Errorf("Unexpected pieces %+v", file.Pieces)
+	}
+
+	metalink3 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.iso">
+      <size>12</size>
+      <verification>
+        <hash type="sha1">da39a3ee5e6b4b0d3255bfef95601890afd80709</hash>
+      </verification>
+      <resources>
+        <url type="http" preference="10">http://b.example.com/example.iso</url>
+        <url type="http" preference="100">http://a.example.com/example.iso</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+	m, err = ParseMetalink([]byte(metalink3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = m.Files[0]
+	if len(file.URLs) != 2 || file.URLs[0].URL != "http://a.example.com/example.iso" {
+		t.Errorf("Unexpected urls %+v", file.URLs)
+	}
+	if file.Checksum == nil || file.Checksum.Algorithm != "sha1" {
+		t.Errorf("Expect sha1 checksum, got %+v", file.Checksum)
+	}
+
+	for _, invalid := range []string{"", "<metalink></metalink>", "<html></html>"} {
+		if _, err = ParseMetalink([]byte(invalid)); err == nil {
+			t.Errorf("Expect error for %q", invalid)
+		}
+	}
+}
+
+func TestDownloadMetalinkFile(t *testing.T) {
+	size := int64(1024 * 1024)
+	pieceLength := int64(256 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	modTime := time.Now().Add(-time.Hour)
+
+	// the first response of the corrupt mirror has wrong content
+	var corrupted int32
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := src
+		if r.Method == "GET" && atomic.CompareAndSwapInt32(&corrupted, 0, 1) {
+			content = make([]byte, size)
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(content))
+	}))
+	defer corrupt.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer good.Close()
+
+	var pieces strings.Builder
+	for begin := int64(0); begin < size; begin += pieceLength {
+		sum := sha256.Sum256(src[begin : begin+pieceLength])
+		fmt.Fprintf(&pieces, "<hash>%x</hash>", sum)
+	}
+	sum := sha256.Sum256(src)
+	meta4 := fmt.Sprintf(`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="../%s">
+<size>%d</size><hash type="sha-256">%s</hash><pieces length="%d" type="sha-256">%s</pieces>
+<url priority="1">%s</url><url priority="2">%s</url></file></metalink>`,
+		filepath.Base(filename), size, hex.EncodeToString(sum[:]), pieceLength, pieces.String(), corrupt.URL, good.URL)
+	m, err := ParseMetalink([]byte(meta4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := m.Files[0]
+	if file.Pieces == nil || len(file.Pieces.Hashes) != 4 {
+		t.Fatalf("Unexpected pieces %+v", file.Pieces)
+	}
+
+	// the file is named by the metalink in the download directory
+	d := NewDefaultDownloader()
+	d.Directory = filepath.Dir(filename)
+	template, _ := http.NewRequest("GET", corrupt.URL, nil)
+	if err = d.DownloadMetalinkFile(template, file, 4, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+	if file.Pieces.Verified() != 4 {
+		t.Errorf("Expect 4 verified pieces, got %d", file.Pieces.Verified())
+	}
+	if atomic.LoadInt32(&corrupted) == 0 {
+		t.Error("Corrupt mirror is not used")
+	}
+}
+
+func TestFetchMetalinkRelative(t *testing.T) {
+	size := int64(64 * 1024)
+	src, dir, cleanup := newTestFile(t, size, "")
+	defer cleanup()
+	modTime := time.Now().Add(-time.Hour)
+
+	// credentials of the metalink host are not sent to the mirror on another host
+	var mirrorHits, mirrorAuth int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrorHits, 1)
+		if r.Header.Get("Authorization") != "" {
+			atomic.StoreInt32(&mirrorAuth, 1)
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer mirror.Close()
+	var meta4 string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/dir/test.meta4" {
+			w.Write([]byte(meta4))
+			return
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer server.Close()
+	meta4 = fmt.Sprintf(`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="file">
+<url priority="1">file</url><url priority="2">%s/file</url><url priority="3">ftp://example.com/file</url></file></metalink>`, mirror.URL)
+
+	m, err := ParseMetalink([]byte(meta4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Resolve(nil); !errors.Is(err, ErrRelativeMetalinkURL) {
+		t.Errorf("Expect relative url rejected without base, got %v", err)
+	}
+
+	template, _ := http.NewRequest("GET", server.URL+"/dir/test.meta4", nil)
+	template.SetBasicAuth("user", "pass")
+	d := NewDefaultDownloader()
+	if m, err = d.FetchMetalink(template); err != nil {
+		t.Fatal(err)
+	}
+	file := m.Files[0]
+	if len(file.URLs) != 2 || file.URLs[0].URL != server.URL+"/dir/file" {
+		t.Fatalf("Unexpected urls %+v", file.URLs)
+	}
+	d.Directory = dir
+	if err = d.DownloadMetalinkFile(template, file, 4, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+	if atomic.LoadInt32(&mirrorHits) == 0 {
+		t.Error("Mirror is not used")
+	}
+	if atomic.LoadInt32(&mirrorAuth) != 0 {
+		t.Error("Credentials are sent to the mirror on another host")
+	}
+}
+
+func TestPiecesReset(t *testing.T) {
+	src := make([]byte, 1024)
+	rand.Read(src)
+	sum := sha256.Sum256(src)
+	pieces, err := NewPieces("sha256", int64(len(src)), [][]byte{sum[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed := []ByteRange{{0, int64(len(src))}}
+	if bad, err := pieces.Verify(bytes.NewReader(src), completed, int64(len(src))); err != nil || len(bad) != 0 || pieces.Verified() != 1 {
+		t.Fatalf("Expect piece verified, bad = %v, err = %v", bad, err)
+	}
+
+	// the data downloaded again after a restart is verified again
+	pieces.reset()
+	if bad, err := pieces.Verify(bytes.NewReader(make([]byte, len(src))), completed, int64(len(src))); err != nil || len(bad) != 1 {
+		t.Errorf("Expect bad piece after reset, bad = %v, err = %v", bad, err)
+	}
+}
@@ -0,0 +1,169 @@
+package downloader
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoMirror = errors.New("No Available Mirror")
+
+	MirrorMaxErrors  = 3
+	MirrorSpeedDecay = 0.7
+)
+
+// Mirror .
+type Mirror struct {
+	Request  *http.Request
+	Priority int
+
+	bytes    int64
+	speed    float64
+	measured bool
+	errors   int
+	failures int
+	disabled bool
+}
+
+// Mirrors .
+type Mirrors struct {
+	mutex    sync.Mutex
+	mirrors  []*Mirror
+	lastTick time.Time
+}
+
+// NewMirrors .
+func NewMirrors(requests ...*http.Request) *Mirrors {
+	m := &Mirrors{lastTick: time.Now()}
+	for _, request := range requests {
+		m.mirrors = append(m.mirrors, &Mirror{Request: request})
+	}
+	return m
+}
+
+func (m *Mirror) String() string {
+	return m.Request.URL.String()
+}
+
+// Speed .
+func (m *Mirror) Speed() float64 {
+	return m.speed
+}
+
+// Mirrors .
+func (m *Mirrors) Mirrors() []*Mirror {
+	return m.mirrors
+}
+
+// Active .
+func (m *Mirrors) Active() []*Mirror {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.active()
+}
+
+func (m *Mirrors) active() []*Mirror {
+	active := make([]*Mirror, 0, len(m.mirrors))
+	for _, mirror := range m.mirrors {
+		if !mirror.disabled {
+			active = append(active, mirror)
+		}
+	}
+	return active
+}
+
+// Pick returns the active mirror with the best expected speed for one more connection.
+func (m *Mirrors) Pick(jobs []*Job) *Mirror {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	load := make(map[*Mirror]int)
+	for _, job := range jobs {
+		if job != nil && job.Mirror != nil && !job.Segment.Finish() {
+			load[job.Mirror]++
+		}
+	}
+
+	var best *Mirror
+	for _, mirror := range m.active() {
+		if best == nil || mirror.better(best, load) {
+			best = mirror
+		}
+	}
+	return best
+}
+
+// better compares mirrors by consecutive failures, then tries unmeasured mirrors by priority and load,
+// then measured mirrors by expected speed of one more connection.
+func (m *Mirror) better(o *Mirror, load map[*Mirror]int) bool {
+	if m.failures != o.failures {
+		return m.failures < o.failures
+	}
+	if m.measured != o.measured {
+		return !m.measured
+	}
+	if !m.measured {
+		if m.Priority != o.Priority {
+			return m.Priority < o.Priority
+		}
+		return load[m] < load[o]
+	}
+	return m.speed/float64(load[m]+1)/float64(m.errors+1) > o.speed/float64(load[o]+1)/float64(o.errors+1)
+}
+
+// Add .
+func (m *Mirrors) Add(mirror *Mirror, n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mirror.bytes += int64(n)
+	mirror.failures = 0
+}
+
+// Tick .
+func (m *Mirrors) Tick() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(m.lastTick).Seconds()
+	m.lastTick = now
+	if elapsed <= 0 {
+		return
+	}
+	for _, mirror := range m.mirrors {
+		speed := float64(mirror.bytes) / elapsed
+		mirror.bytes = 0
+		if !mirror.measured {
+			if speed > 0 {
+				mirror.speed, mirror.measured = speed, true
+			}
+			continue
+		}
+		mirror.speed = MirrorSpeedDecay*mirror.speed + (1-MirrorSpeedDecay)*speed
+	}
+}
+
+// Fail records an error of mirror, and returns whether the mirror is dropped.
+func (m *Mirrors) Fail(mirror *Mirror, err error) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mirror.errors++
+	mirror.failures++
+	if mirror.disabled {
+		return true
+	}
+	if IsRetryable(err) && !errors.Is(err, ErrRemoteChanged) && mirror.failures < MirrorMaxErrors {
+		return false
+	}
+	if len(m.active()) <= 1 {
+		return false
+	}
+	logrus.Warnf("Drop mirror %s: %v", mirror, err)
+	mirror.disabled = true
+	return true
+}
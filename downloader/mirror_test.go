@@ -0,0 +1,77 @@
+package downloader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileMirrors(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	modTime := time.Now().Add(-time.Hour)
+
+	var goodCount, badCount int64
+	good := func(count *int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				atomic.AddInt64(count, 1)
+			}
+			http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+		}))
+	}
+	primary := good(&goodCount)
+	defer primary.Close()
+	mirror := good(&goodCount)
+	defer mirror.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt64(&badCount, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer broken.Close()
+	different := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src[1:]))
+	}))
+	defer different.Close()
+
+	var requests []*http.Request
+	for _, server := range []*httptest.Server{primary, broken, different, mirror} {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		requests = append(requests, request)
+	}
+
+	begin := time.Now()
+	// keep the state file to check the mirrors in it
+	d := NewDefaultDownloader()
+	d.InPlace = true
+	if err := d.DownloadFileMirrors(requests, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed > ReadTimeout/2 {
+		t.Errorf("Broken mirror slows down download: %v", elapsed)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+	if goodCount < 2 || badCount == 0 {
+		t.Errorf("Jobs are not spread across mirrors, good: %d, broken: %d", goodCount, badCount)
+	}
+
+	b, _ := ioutil.ReadFile(filename + ".state")
+	state, err := StateReadFromByte(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.URLs) != 3 || state.URLs[0] != primary.URL {
+		t.Errorf("Unexpected mirrors in state: %v", state.URLs)
+	}
+}
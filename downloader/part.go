@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PartSuffix is appended to the filename while downloading.
+const PartSuffix = ".part"
+
+// partFilename returns the file to download into, and whether the file at the final name is moved to it.
+// An existing file at the final name is a partial download of the continue policy or of an in-place download,
+// it is moved to the part file with its state, and moved back by restorePart if the download fails.
+func (d *Downloader) partFilename(filename string) (string, bool, error) {
+	if d.InPlace {
+		return filename, false, nil
+	}
+	part := filename + PartSuffix
+	if !exists(filename) || exists(part) {
+		return part, false, nil
+	}
+	logrus.Infof("Continue %s as %s", filename, part)
+	if err := renameWithState(filename, part); err != nil {
+		return "", false, &Error{Op: "rename", Err: err}
+	}
+	return part, true, nil
+}
+
+// restorePart moves the part file back to the final name, so a failed download keeps the file where it was.
+func restorePart(part, filename string) {
+	if !exists(part) || exists(filename) {
+		return
+	}
+	if err := renameWithState(part, filename); err != nil {
+		logrus.Errorf("Restore %s error: %v", filename, err)
+		return
+	}
+	logrus.Debugf("Restore %s to %s", part, filename)
+}
+
+// renameWithState renames the file along with its state file.
+func renameWithState(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if exists(from + ".state") {
+		return os.Rename(from+".state", to+".state")
+	}
+	return nil
+}
+
+// finalize syncs the completed part file, renames it to the final name and removes its state file.
+func finalize(part, filename string) error {
+	file, err := os.OpenFile(part, os.O_RDWR, 0644)
+	if err != nil {
+		return &Error{Op: "open", Err: err}
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return &Error{Op: "sync", Err: err}
+	}
+	if err = os.Rename(part, filename); err != nil {
+		return &Error{Op: "rename", Err: err}
+	}
+	syncDir(filepath.Dir(filename))
+	if err = os.Remove(part + ".state"); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Remove state of %s error: %v", filename, err)
+	}
+	logrus.Debugf("Rename %s to %s", part, filename)
+	return nil
+}
+
+// syncDir persists a rename in the directory, it is best effort as some platforms cannot sync a directory.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
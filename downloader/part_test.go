@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadFilePart(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	modTime := time.Now().Add(-time.Hour)
+	var slow int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			w = &slowResponseWriter{w, 50 * time.Millisecond}
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	// an interrupted download leaves only the part file and its state
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := NewDefaultDownloader().DownloadFileContext(ctx, request, 4, filename); err == nil {
+		t.Fatal("Expect download interrupted")
+	}
+	for name, exist := range map[string]bool{filename: false, filename + ".part": true, filename + ".part.state": true} {
+		if _, err := os.Stat(name); (err == nil) != exist {
+			t.Errorf("Expect %s exists: %v", name, exist)
+		}
+	}
+
+	atomic.StoreInt32(&slow, 0)
+	if err := NewDefaultDownloader().DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+	for _, name := range []string{filename + ".part", filename + ".part.state", filename + ".state"} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("Expect %s removed", name)
+		}
+	}
+
+	// in place download keeps the old behavior
+	os.Remove(filename)
+	d := NewDefaultDownloader()
+	d.InPlace = true
+	if err := d.DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename + ".state"); err != nil {
+		t.Errorf("Expect state file kept: %v", err)
+	}
+	if _, err := os.Stat(filename + ".part"); err == nil {
+		t.Error("Expect no part file")
+	}
+}
+
+func TestDownloadFilePartRestore(t *testing.T) {
+	src, filename, cleanup := newTestFile(t, 1024, "file")
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	// a failed re-run keeps the existing file at its name
+	ioutil.WriteFile(filename, src, 0644)
+	d := NewDefaultDownloader()
+	d.Retry = &RetryPolicy{MaxAttempts: 1}
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := d.DownloadFile(request, 4, filename); err == nil {
+		t.Fatal("Expect download failed")
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Existing file is not restored")
+	}
+	if _, err := os.Stat(filename + PartSuffix); err == nil {
+		t.Error("Expect no part file")
+	}
+}
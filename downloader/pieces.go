@@ -0,0 +1,110 @@
+package downloader
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxPieceFailures .
+var MaxPieceFailures = 3
+
+// Pieces .
+type Pieces struct {
+	Length    int64
+	Algorithm string
+	Hashes    [][]byte
+
+	verified []bool
+	failures []int
+}
+
+// NewPieces .
+func NewPieces(algorithm string, length int64, hashes [][]byte) (*Pieces, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	for _, sum := range hashes {
+		if len(sum) != h.Size() {
+			return nil, ErrWrongChecksumFormat
+		}
+	}
+	if length <= 0 {
+		return nil, ErrInvalidSize
+	}
+	return &Pieces{
+		Length:    length,
+		Algorithm: algorithm,
+		Hashes:    hashes,
+		verified:  make([]bool, len(hashes)),
+		failures:  make([]int, len(hashes)),
+	}, nil
+}
+
+// Piece .
+func (p *Pieces) Piece(index int, size int64) ByteRange {
+	r := ByteRange{int64(index) * p.Length, int64(index+1) * p.Length}
+	if r.End > size {
+		r.End = size
+	}
+	return r
+}
+
+// Verify hashes the pieces newly covered by completed ranges, and returns the ranges of mismatched pieces.
+func (p *Pieces) Verify(src io.ReaderAt, completed []ByteRange, size int64) ([]ByteRange, error) {
+	var bad []ByteRange
+	for _, r := range MergeRanges(completed) {
+		first := int((r.Begin + p.Length - 1) / p.Length)
+		for index := first; index < len(p.Hashes); index++ {
+			piece := p.Piece(index, size)
+			if piece.End > r.End {
+				break
+			}
+			if p.verified[index] {
+				continue
+			}
+
+			h, err := NewHash(p.Algorithm)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = io.Copy(h, io.NewSectionReader(src, piece.Begin, piece.Length())); err != nil {
+				return nil, err
+			}
+			if bytes.Equal(h.Sum(nil), p.Hashes[index]) {
+				p.verified[index] = true
+				continue
+			}
+
+			p.failures[index]++
+			logrus.Warnf("Piece %d (%s) hash mismatch, %d times", index, piece, p.failures[index])
+			if p.failures[index] >= MaxPieceFailures {
+				return nil, &Error{Op: "verify piece", Begin: piece.Begin, End: piece.End, Err: ErrChecksumMismatch}
+			}
+			bad = append(bad, piece)
+		}
+	}
+	return bad, nil
+}
+
+// reset forgets the verified pieces and failures, when the data they are checked against is discarded.
+func (p *Pieces) reset() {
+	if p == nil {
+		return
+	}
+	p.verified = make([]bool, len(p.Hashes))
+	p.failures = make([]int, len(p.Hashes))
+}
+
+// Verified .
+func (p *Pieces) Verified() int {
+	count := 0
+	for _, v := range p.verified {
+		if v {
+			count++
+		}
+	}
+	return count
+}
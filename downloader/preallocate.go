@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// preallocate reserves size bytes for the file and cuts a longer file to size, it fails with ErrDiskFull if the free space
+// is not enough.
+func preallocate(file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > size {
+		if err = file.Truncate(size); err != nil {
+			return err
+		}
+		if info, err = file.Stat(); err != nil {
+			return err
+		}
+	}
+	allocated := allocatedSize(info)
+	if allocated >= size {
+		return nil
+	}
+	if err = checkSpace(file.Name(), size-allocated); err != nil {
+		return err
+	}
+	if err = fallocate(file, size); err == nil || isNoSpace(err) {
+		return err
+	}
+	// the file system cannot allocate, grow a sparse file instead
+	if info.Size() < size {
+		return file.Truncate(size)
+	}
+	return nil
+}
+
+// checkSpace fails with ErrDiskFull if the file system of filename has less than size bytes free.
+func checkSpace(filename string, size int64) error {
+	free, err := freeSpace(filepath.Dir(filename))
+	if err != nil || free >= size {
+		return nil
+	}
+	return fmt.Errorf("%w: need %s, %s free", ErrDiskFull, SizeToReadable(float64(size)), SizeToReadable(float64(free)))
+}
@@ -0,0 +1,10 @@
+package downloader
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(file *os.File, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), 0, 0, size)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package downloader
+
+import (
+	"errors"
+	"os"
+)
+
+func fallocate(file *os.File, size int64) error {
+	return errors.New("fallocate is not supported")
+}
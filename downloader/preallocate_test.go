@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	file, err := ioutil.TempFile("", "gget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err = preallocate(file, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := file.Stat(); info.Size() != 1024*1024 {
+		t.Errorf("Expect preallocated size %d, got %d", 1024*1024, info.Size())
+	}
+
+	if _, err := freeSpace(os.TempDir()); err != nil {
+		t.Skipf("Free space is unknown: %v", err)
+	}
+	if err = preallocate(file, 1<<60); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Expect disk full, got %v", err)
+	}
+}
+
+func TestSingleThreadResumePreallocated(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+
+	// an interrupted multi thread download leaves a full size part file with holes
+	data := make([]byte, size)
+	copy(data[:size/4], src)
+	copy(data[size/2:], src[size/2:])
+	state := NewState(server.URL)
+	state.Validator = Validator{ETag: `"v1"`, Length: size}
+	state.Segments = NewSegments([]*Segment{{begin: 0, position: size / 4, end: size / 2}, {begin: size / 2, position: size, end: size}})
+	ioutil.WriteFile(filename+".part", data, 0644)
+	ioutil.WriteFile(filename+".part.state", state.ToByte(), 0644)
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := NewDefaultDownloader().DownloadFile(request, 1, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+}
+
+func TestMultiThreadDownloadLongerFile(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+
+	// a longer file without state is cut rather than kept with stale bytes at the end
+	stale := make([]byte, 3*size)
+	rand.Read(stale)
+	ioutil.WriteFile(filename, stale, 0644)
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := NewDefaultDownloader().DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Errorf("Content mismatch, got %d bytes", len(b))
+	}
+
+	file, err := ioutil.TempFile("", "gget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	file.Write(stale)
+	if err = preallocate(file, size); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := file.Stat(); info.Size() != size {
+		t.Errorf("Expect size %d, got %d", size, info.Size())
+	}
+}
@@ -0,0 +1,176 @@
+package downloader
+
+import (
+	"time"
+)
+
+// EventType .
+type EventType int
+
+// Event types, a download reports EventStarted or EventResumed once, then EventProgress and EventRetrying,
+// and ends with EventFinished or EventFailed.
+const (
+	EventStarted EventType = iota
+	EventResumed
+	EventProgress
+	EventRetrying
+	EventFinished
+	EventFailed
+)
+
+var eventNames = []string{"started", "resumed", "progress", "retrying", "finished", "failed"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[t]
+}
+
+// SegmentProgress .
+type SegmentProgress struct {
+	Begin   int64
+	Current int64
+	End     int64
+	// JobId is the job filling the segment, 0 if none
+	JobId  int
+	Active bool
+}
+
+// Progress .
+type Progress struct {
+	Filename string
+	Done     int64
+	// Total is -1 if unknown
+	Total int64
+	// Speed is bytes per second since last event
+	Speed float64
+	// ETA is -1 if unknown
+	ETA         time.Duration
+	Elapsed     time.Duration
+	Connections int
+	Retries     int
+	Segments    []SegmentProgress
+}
+
+// Event .
+type Event struct {
+	Type EventType
+	Progress
+	Err error
+}
+
+// Observer receives events of downloads, it is called from the download goroutine, so it should return quickly.
+type Observer interface {
+	OnEvent(event Event)
+}
+
+// ObserverFunc .
+type ObserverFunc func(event Event)
+
+// OnEvent .
+func (f ObserverFunc) OnEvent(event Event) {
+	f(event)
+}
+
+// tracker builds the events of one download, a nil tracker drops everything.
+type tracker struct {
+	observer Observer
+	progress Progress
+	begin    time.Time
+	last     time.Time
+	lastDone int64
+	started  bool
+}
+
+func (d *Downloader) newTracker(filename string) *tracker {
+	if d.Observer == nil {
+		return nil
+	}
+	now := time.Now()
+	return &tracker{
+		observer: d.Observer,
+		progress: Progress{Filename: filename, Total: -1, ETA: -1},
+		begin:    now,
+		last:     now,
+	}
+}
+
+func (t *tracker) emit(typ EventType, err error) {
+	t.progress.Elapsed = time.Since(t.begin)
+	event := Event{Type: typ, Progress: t.progress, Err: err}
+	event.Segments = append([]SegmentProgress(nil), t.progress.Segments...)
+	t.observer.OnEvent(event)
+}
+
+// start reports started or resumed, only once per download.
+func (t *tracker) start(done, total int64) {
+	if t == nil || t.started {
+		return
+	}
+	t.started = true
+	t.progress.Done, t.progress.Total = done, total
+	t.lastDone, t.last = done, time.Now()
+	if done > 0 {
+		t.emit(EventResumed, nil)
+	} else {
+		t.emit(EventStarted, nil)
+	}
+}
+
+func (t *tracker) update(done int64, connections int, segments []SegmentProgress) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	if elapsed := now.Sub(t.last).Seconds(); elapsed > 0 {
+		t.progress.Speed = float64(done-t.lastDone) / elapsed
+	}
+	t.last, t.lastDone = now, done
+	t.progress.Done, t.progress.Connections, t.progress.Segments = done, connections, segments
+	t.progress.ETA = -1
+	if t.progress.Total >= 0 && t.progress.Speed > 0 {
+		t.progress.ETA = time.Duration(float64(t.progress.Total-done) / t.progress.Speed * float64(time.Second))
+	}
+	t.emit(EventProgress, nil)
+}
+
+func (t *tracker) retry(err error) {
+	if t == nil {
+		return
+	}
+	t.progress.Retries++
+	t.emit(EventRetrying, err)
+}
+
+func (t *tracker) finish(err error) {
+	if t == nil {
+		return
+	}
+	t.progress.Connections = 0
+	if err != nil {
+		t.emit(EventFailed, err)
+		return
+	}
+	t.progress.ETA = 0
+	if t.progress.Total >= 0 {
+		t.progress.Done = t.progress.Total
+	}
+	t.emit(EventFinished, nil)
+}
+
+// segmentProgress .
+func segmentProgress(segments *Segments) []SegmentProgress {
+	segs := segments.Segments()
+	progress := make([]SegmentProgress, 0, len(segs))
+	for _, seg := range segs {
+		progress = append(progress, SegmentProgress{
+			Begin:   seg.Begin(),
+			Current: seg.Current(),
+			End:     seg.End(),
+			JobId:   seg.JobId(),
+			Active:  seg.Active(),
+		})
+	}
+	return progress
+}
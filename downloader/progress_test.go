@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) OnEvent(event Event) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.Lock()
+	defer r.Unlock()
+	types := make([]EventType, 0, len(r.events))
+	for _, event := range r.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestDownloadFileProgress(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+
+	for _, thread := range []int{1, 4} {
+		os.Remove(filename)
+		os.Remove(filename + ".state")
+		recorder := &eventRecorder{}
+		d := NewDefaultDownloader()
+		d.Observer = recorder
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		if err := d.DownloadFile(request, thread, filename); err != nil {
+			t.Fatalf("Thread %d: %v", thread, err)
+		}
+
+		types := recorder.types()
+		if len(types) < 2 || types[0] != EventStarted || types[len(types)-1] != EventFinished {
+			t.Fatalf("Thread %d: unexpected events %v", thread, types)
+		}
+		last := recorder.events[len(recorder.events)-1]
+		if last.Done != size || last.Total != size || last.Filename != filename || last.Err != nil {
+			t.Errorf("Thread %d: unexpected final event %+v", thread, last)
+		}
+	}
+}
+
+func TestDownloadFileProgressResumedAndFailed(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+
+	state := &State{
+		Validator: Validator{ETag: `"v1"`, Length: size},
+		Segments:  NewSegments([]*Segment{{begin: 0, position: size / 2, end: size}}),
+	}
+	file, _ := os.Create(filename)
+	file.Write(src[:size/2])
+	file.Close()
+	stateFile, _ := os.Create(filename + ".state")
+	stateFile.Write(state.ToByte())
+	stateFile.Close()
+
+	// slow down the server to get progress events
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == "GET" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "test", time.Now().Add(-time.Hour), bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	recorder := &eventRecorder{}
+	d := NewDefaultDownloader()
+	d.Observer = recorder
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := d.DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	types := recorder.types()
+	if len(types) < 3 || types[0] != EventResumed || types[len(types)-1] != EventFinished {
+		t.Fatalf("Unexpected events %v", types)
+	}
+	if first := recorder.events[0]; first.Done != size/2 {
+		t.Errorf("Expect resumed at %d, got %d", size/2, first.Done)
+	}
+	progress := recorder.events[1]
+	if progress.Type != EventProgress || len(progress.Segments) == 0 || progress.Connections == 0 {
+		t.Errorf("Unexpected progress event %+v", progress)
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	recorder = &eventRecorder{}
+	d.Observer = recorder
+	request, _ = http.NewRequest("GET", missing.URL, nil)
+	if err := d.DownloadFile(request, 4, filename+"-missing"); err == nil {
+		t.Fatal("Expect error for missing file")
+	}
+	types = recorder.types()
+	if len(types) != 1 || types[0] != EventFailed || recorder.events[0].Err == nil {
+		t.Errorf("Unexpected events %v", types)
+	}
+}
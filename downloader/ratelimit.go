@@ -0,0 +1,122 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxRateLimitRead .
+var MaxRateLimitRead = 32 * 1024
+
+// RateLimiter is a token bucket shared by every connection of a downloader, rate <= 0 means unlimited.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+	// changed is closed and replaced by SetRate to wake the waiters
+	changed chan struct{}
+}
+
+// RateLimitedReader .
+type RateLimitedReader struct {
+	ctx     context.Context
+	src     io.Reader
+	limiter *RateLimiter
+}
+
+// NewRateLimiter .
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, last: time.Now(), changed: make(chan struct{})}
+}
+
+// SetRate .
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens < 0 || rate <= 0 {
+		l.tokens = 0
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate .
+func (l *RateLimiter) Rate() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if burst := float64(l.rate); l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+}
+
+// WaitN takes n tokens and waits until the debt is paid, it re-checks the wait when the rate is changed.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	for {
+		wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		changed := l.changed
+		l.mutex.Unlock()
+
+		if wait <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+			timer.Stop()
+		}
+
+		l.mutex.Lock()
+		if l.rate <= 0 {
+			l.mutex.Unlock()
+			return nil
+		}
+		l.refill(time.Now())
+	}
+}
+
+// NewRateLimitedReader .
+func NewRateLimitedReader(ctx context.Context, src io.Reader, limiter *RateLimiter) io.Reader {
+	if limiter == nil {
+		return src
+	}
+	return &RateLimitedReader{ctx: ctx, src: src, limiter: limiter}
+}
+
+func (r *RateLimitedReader) Read(b []byte) (int, error) {
+	if len(b) > MaxRateLimitRead {
+		b = b[:MaxRateLimitRead]
+	}
+	n, err := r.src.Read(b)
+	if n > 0 {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,61 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	src := make([]byte, 512*1024)
+	limiter := NewRateLimiter(1024 * 1024)
+
+	begin := time.Now()
+	n, err := io.Copy(ioutil.Discard, NewRateLimitedReader(context.Background(), bytes.NewReader(src), limiter))
+	if err != nil || n != int64(len(src)) {
+		t.Fatalf("Copy %d, %v", n, err)
+	}
+	if elapsed := time.Since(begin); elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("Read 512K at 1M/s takes %v", elapsed)
+	}
+
+	limiter.SetRate(0)
+	begin = time.Now()
+	io.Copy(ioutil.Discard, NewRateLimitedReader(context.Background(), bytes.NewReader(src), limiter))
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Errorf("Unlimited read takes %v", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := NewRateLimiter(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.WaitN(ctx, 1024*1024); err != context.DeadlineExceeded {
+		t.Errorf("Expect %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.WaitN(context.Background(), 1024*1024)
+	}()
+
+	// waiters are woken to re-check the new rate rather than sleeping by the old one
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetRate(1024 * 1024)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Waiter is not woken by SetRate")
+	}
+}
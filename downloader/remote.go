@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+var (
+	ErrInvalidSeek = errors.New("Invalid Seek")
+
+	RemoteBlockSize int64 = 64 * 1024
+	// RemoteCacheBlocks is the max blocks cached by a remote file
+	RemoteCacheBlocks = 256
+	// RemoteReadahead is the blocks fetched ahead of sequential reads
+	RemoteReadahead = 8
+)
+
+// RemoteFile reads a remote file at random positions by range requests, with a block cache and readahead.
+type RemoteFile struct {
+	d       *Downloader
+	ctx     context.Context
+	request *http.Request
+	size    int64
+
+	mutex  sync.Mutex
+	offset int64
+	blocks map[int64]*list.Element
+	lru    *list.List
+	next   int64
+}
+
+type block struct {
+	index int64
+	data  []byte
+}
+
+// OpenRemoteFile .
+func (d *Downloader) OpenRemoteFile(ctx context.Context, req *http.Request) (*RemoteFile, error) {
+	remote, err := d.DetectRemoteContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !remote.Range {
+		return nil, &Error{Op: "detect", URL: req.URL.String(), Err: ErrUnsupport206}
+	}
+	request := req.Clone(ctx)
+	SetIfRange(request, remote.Validator)
+	return &RemoteFile{
+		d:       d,
+		ctx:     ctx,
+		request: request,
+		size:    remote.Length,
+		blocks:  make(map[int64]*list.Element),
+		lru:     list.New(),
+		next:    -1,
+	}, nil
+}
+
+// Size .
+func (f *RemoteFile) Size() int64 {
+	return f.size
+}
+
+// ReadAt .
+func (f *RemoteFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidSeek
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= f.size {
+			return n, io.EOF
+		}
+		data, err := f.block(pos / RemoteBlockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(b[n:], data[pos%RemoteBlockSize:])
+	}
+	return n, nil
+}
+
+// block returns the cached block, or fetches it with the following missing blocks for sequential reads.
+// It is called with f.mutex held, which is released during the fetch.
+func (f *RemoteFile) block(index int64) ([]byte, error) {
+	if e, ok := f.blocks[index]; ok {
+		f.lru.MoveToFront(e)
+		if index == f.next {
+			f.next++
+		}
+		return e.Value.(*block).data, nil
+	}
+
+	last := index
+	if index == f.next {
+		// readahead never evicts the block being read
+		readahead := RemoteReadahead
+		if readahead > RemoteCacheBlocks-1 {
+			readahead = RemoteCacheBlocks - 1
+		}
+		lastBlock := (f.size - 1) / RemoteBlockSize
+		for i := 0; i < readahead && last < lastBlock; i++ {
+			if _, ok := f.blocks[last+1]; ok {
+				break
+			}
+			last++
+		}
+	}
+	c := &chunk{begin: index * RemoteBlockSize, end: (last + 1) * RemoteBlockSize}
+	if c.end > f.size {
+		c.end = f.size
+	}
+	f.mutex.Unlock()
+	err := f.d.fetchChunk(f.ctx, f.request, c)
+	f.mutex.Lock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the block being read is pushed last to be the most recently used
+	var data []byte
+	for i := last; i >= index; i-- {
+		begin := (i - index) * RemoteBlockSize
+		end := begin + RemoteBlockSize
+		if end > int64(len(c.data)) {
+			end = int64(len(c.data))
+		}
+		data = c.data[begin:end:end]
+		if e, ok := f.blocks[i]; ok {
+			// fetched by a concurrent read
+			f.lru.MoveToFront(e)
+			continue
+		}
+		f.blocks[i] = f.lru.PushFront(&block{index: i, data: data})
+	}
+	for f.lru.Len() > RemoteCacheBlocks {
+		e := f.lru.Back()
+		f.lru.Remove(e)
+		delete(f.blocks, e.Value.(*block).index)
+	}
+	f.next = index + 1
+	return data, nil
+}
+
+func (f *RemoteFile) Read(b []byte) (int, error) {
+	f.mutex.Lock()
+	offset := f.offset
+	f.mutex.Unlock()
+
+	n, err := f.ReadAt(b, offset)
+	f.mutex.Lock()
+	f.offset = offset + int64(n)
+	f.mutex.Unlock()
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek .
+func (f *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, ErrInvalidSeek
+	}
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+	f.offset = offset
+	return offset, nil
+}
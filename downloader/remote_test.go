@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteFile(t *testing.T) {
+	size := int64(3*1024*1024 + 17)
+	src := make([]byte, size)
+	rand.Read(src)
+	var gets int32
+	server := newETagServer(src, func(r *http.Request) string {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		return `"v1"`
+	})
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	f, err := NewDefaultDownloader().OpenRemoteFile(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size() != size {
+		t.Fatalf("Expect size %d, got %d", size, f.Size())
+	}
+
+	b := make([]byte, 100)
+	for _, off := range []int64{0, size - 100, RemoteBlockSize - 50, 1024 * 1024} {
+		if n, err := f.ReadAt(b, off); n != 100 || err != nil || !bytes.Equal(b, src[off:off+100]) {
+			t.Errorf("ReadAt %d: n = %d, err = %v", off, n, err)
+		}
+	}
+	if n, err := f.ReadAt(b, size-10); n != 10 || err != io.EOF {
+		t.Errorf("Expect EOF at end, n = %d, err = %v", n, err)
+	}
+
+	// sequential reads are served by readahead
+	atomic.StoreInt32(&gets, 0)
+	if _, err = f.Seek(2*1024*1024, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, src[2*1024*1024:]) {
+		t.Errorf("Unexpected sequential read: %v", err)
+	}
+	blocks := int32((size - 2*1024*1024 + RemoteBlockSize - 1) / RemoteBlockSize)
+	if gets := atomic.LoadInt32(&gets); gets > blocks/int32(RemoteReadahead)+2 {
+		t.Errorf("Expect readahead, %d requests for %d blocks", gets, blocks)
+	}
+	if pos, _ := f.Seek(-10, io.SeekEnd); pos != size-10 {
+		t.Errorf("Unexpected seek position %d", pos)
+	}
+}
+
+func TestRemoteFileZip(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	w := zip.NewWriter(buffer)
+	large := make([]byte, 2*1024*1024)
+	rand.Read(large)
+	for name, content := range map[string][]byte{"a.txt": []byte("hello"), "dir/large.bin": large} {
+		fw, _ := w.Create(name)
+		fw.Write(content)
+	}
+	w.Close()
+	src := buffer.Bytes()
+
+	var transferred int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &countResponseWriter{ResponseWriter: w, count: &transferred}
+		http.ServeContent(rw, r, "test.zip", time.Now().Add(-time.Hour), bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	f, err := NewDefaultDownloader().OpenRemoteFile(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := zip.NewReader(f, f.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range reader.File {
+		if member.Name != "a.txt" {
+			continue
+		}
+		rc, _ := member.Open()
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(b) != "hello" {
+			t.Errorf("Unexpected content %q", b)
+		}
+	}
+	if transferred := atomic.LoadInt64(&transferred); transferred > int64(len(src))/4 {
+		t.Errorf("Read %d bytes of %d for a small member", transferred, len(src))
+	}
+}
+
+type countResponseWriter struct {
+	http.ResponseWriter
+	count *int64
+}
+
+func (w *countResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
+
+func TestRemoteFileSmallCache(t *testing.T) {
+	cacheBlocks, readahead := RemoteCacheBlocks, RemoteReadahead
+	defer func() { RemoteCacheBlocks, RemoteReadahead = cacheBlocks, readahead }()
+	RemoteCacheBlocks, RemoteReadahead = 2, 8
+
+	size := int64(1024*1024 + 17)
+	src := make([]byte, size)
+	rand.Read(src)
+	server := newETagServer(src, func(r *http.Request) string { return `"v1"` })
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	f, err := NewDefaultDownloader().OpenRemoteFile(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(b, src) {
+		t.Errorf("Unexpected sequential read: %v", err)
+	}
+
+	// concurrent readers fetch without blocking each other
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			b := make([]byte, RemoteBlockSize)
+			if n, err := f.ReadAt(b, off); err != nil || !bytes.Equal(b[:n], src[off:off+int64(n)]) {
+				t.Errorf("ReadAt %d: n = %d, err = %v", off, n, err)
+			}
+		}(int64(i) * size / 9)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,106 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides how many times and how long to wait before retrying, 0 means unlimited for the counts.
+type RetryPolicy struct {
+	// MaxAttempts is the attempts of a whole download
+	MaxAttempts int
+	// SegmentRetries is the consecutive failures of a segment without progress
+	SegmentRetries int
+	// DownloadRetries is the total failures of segments in a download attempt
+	DownloadRetries int
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the random fraction added to or removed from a backoff
+	Jitter float64
+	// MaxRetryAfter caps the wait asked by Retry-After
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy .
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    1,
+		SegmentRetries: 10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxRetryAfter:  5 * time.Minute,
+	}
+}
+
+func (d *Downloader) retryPolicy() *RetryPolicy {
+	if d.Retry == nil {
+		return DefaultRetryPolicy()
+	}
+	return d.Retry
+}
+
+// Backoff returns the wait before the retry after n failures, it honors retryAfter from the server.
+func (p *RetryPolicy) Backoff(n int, retryAfter time.Duration) time.Duration {
+	delay := float64(p.InitialBackoff) * math.Pow(math.Max(p.Multiplier, 1), float64(n-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	if retryAfter > time.Duration(delay) {
+		if p.MaxRetryAfter > 0 && retryAfter > p.MaxRetryAfter {
+			retryAfter = p.MaxRetryAfter
+		}
+		return retryAfter
+	}
+	return time.Duration(delay)
+}
+
+// RetryAfter returns the wait asked by the server in err, 0 if none.
+func RetryAfter(err error) time.Duration {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// ParseRetryAfter parses Retry-After in seconds or http date.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
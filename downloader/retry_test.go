@@ -0,0 +1,117 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2, MaxRetryAfter: time.Minute}
+	for n, expect := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if delay := policy.Backoff(n+1, 0); delay != expect {
+			t.Errorf("Backoff %d: expect %s, got %s", n+1, expect, delay)
+		}
+	}
+	if delay := policy.Backoff(1, 30*time.Second); delay != 30*time.Second {
+		t.Errorf("Expect Retry-After honored, got %s", delay)
+	}
+	if delay := policy.Backoff(1, time.Hour); delay != time.Minute {
+		t.Errorf("Expect Retry-After capped, got %s", delay)
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := policy.Backoff(2, 0); delay < time.Second || delay > 3*time.Second {
+			t.Fatalf("Jitter out of range: %s", delay)
+		}
+	}
+
+	now := time.Now()
+	for value, expect := range map[string]time.Duration{
+		"":   0,
+		"3":  3 * time.Second,
+		"-1": 0,
+		now.Add(time.Minute).UTC().Format(http.TimeFormat): time.Minute,
+		"invalid": 0,
+	} {
+		if d := ParseRetryAfter(value, now); d < expect-time.Second || d > expect {
+			t.Errorf("Retry-After %q: expect %s, got %s", value, expect, d)
+		}
+	}
+}
+
+func TestDownloadFileRetryAfter(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	modTime := time.Now().Add(-time.Hour)
+
+	var throttled int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && atomic.AddInt32(&throttled, 1) <= 2 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	begin := time.Now()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if err := NewDefaultDownloader().DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < time.Second || elapsed > ReadTimeout/2 {
+		t.Errorf("Expect retry after 1s rather than read timeout, elapsed %s", elapsed)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+}
+
+func TestDownloadFileRetryBudget(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	modTime := time.Now().Add(-time.Hour)
+
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	d := NewDefaultDownloader()
+	d.Retry = &RetryPolicy{MaxAttempts: 2, SegmentRetries: 2, InitialBackoff: 10 * time.Millisecond, Multiplier: 2}
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	err := d.DownloadFile(request, 1, filename)
+	if !errors.Is(err, ErrServerError) {
+		t.Errorf("Expect server error, got %v", err)
+	}
+	if gets != 2 {
+		t.Errorf("Expect 2 attempts of single thread download, got %d", gets)
+	}
+
+	atomic.StoreInt32(&gets, 0)
+	d.Retry.MaxAttempts = 1
+	err = d.DownloadFile(request, 2, filename)
+	if !errors.Is(err, ErrServerError) {
+		t.Errorf("Expect server error, got %v", err)
+	}
+	// 2 jobs, every job gives up after 2 retries
+	if gets < 3 || gets > 6 {
+		t.Errorf("Expect segment retries within budget, got %d requests", gets)
+	}
+}
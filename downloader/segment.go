@@ -8,6 +8,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
@@ -21,22 +23,35 @@ var (
 	ErrSegmentFinish      = errors.New("Segment Finish")
 	ErrAllSegmentIsFinish = errors.New("All Segment Is Finish")
 	ErrSendLimit          = errors.New("Send Limit Error")
+	ErrSegmentGap         = errors.New("Segment Write Leaves Gap")
+	ErrStaleAttempt       = errors.New("Stale Attempt")
+
+	attempts uint64
 )
 
-// Segment .
+// Segment is written by its job while the download loop splits and inspects it, so its fields are guarded by mutex.
 type Segment struct {
+	mutex    sync.Mutex
 	jobid    int
+	attempt  uint64
 	begin    int64
 	end      int64
 	position int64
 	dst      io.WriterAt
 }
 
-// Segments .
+// Segments is inspected by the download loop and saved by the interrupt hook, so it is guarded by mutex.
 type Segments struct {
+	mutex    sync.Mutex
 	segments []*Segment
 }
 
+// ByteRange .
+type ByteRange struct {
+	Begin int64
+	End   int64
+}
+
 // NewSegment .
 func NewSegment(begin, end int64) *Segment {
 	return &Segment{begin: begin, position: begin, end: end}
@@ -68,98 +83,184 @@ func SegmentFromString(s string) (*Segment, error) {
 }
 
 // Write .
-func (s *Segment) Write(b []byte) (size int, err error) {
-	if s.Finish() {
+func (s *Segment) Write(b []byte) (int, error) {
+	return s.WriteAt(b, s.Current())
+}
+
+// WriteAt writes the data at off of the file, which must not be after the current position.
+// Data before the current position is already written and skipped, so a restarted job may overlap its previous run.
+// The file is written without the lock, and the position only moves forward.
+func (s *Segment) WriteAt(b []byte, off int64) (int, error) {
+	return s.writeAttempt(b, off, 0)
+}
+
+// newAttempt returns a unique id of a job attempt.
+func newAttempt() uint64 {
+	return atomic.AddUint64(&attempts, 1)
+}
+
+// own makes attempt the only writer of the segment, writes of previous attempts are rejected.
+func (s *Segment) own(attempt uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attempt = attempt
+}
+
+// writeAttempt writes as WriteAt if the attempt owns the segment, attempt 0 skips the check.
+func (s *Segment) writeAttempt(b []byte, off int64, attempt uint64) (int, error) {
+	s.mutex.Lock()
+	if s.position >= s.end {
+		s.mutex.Unlock()
 		return 0, ErrSegmentFinish
 	}
-	if !s.Active() {
-		logrus.Debugf("segment[inactive] %s add %d", s, size)
+	if s.jobid == 0 {
+		s.mutex.Unlock()
 		return 0, ErrSegmentNotActive
 	}
+	if attempt != 0 && attempt != s.attempt {
+		s.mutex.Unlock()
+		return 0, ErrStaleAttempt
+	}
+	if off > s.position {
+		s.mutex.Unlock()
+		return 0, ErrSegmentGap
+	}
+	skip := int(s.position - off)
+	if skip >= len(b) {
+		s.mutex.Unlock()
+		return len(b), nil
+	}
+	position, dst := s.position, s.dst
+	size := len(b) - skip
+	if int64(size) > s.end-position {
+		size = int(s.end - position)
+	}
+	s.mutex.Unlock()
 
-	size = len(b)
-	if size > int(s.Remaining()) {
-		logrus.Debugf("segment %s add %d too longer", s, size)
-		size = int(s.Remaining())
+	n, err := dst.WriteAt(b[skip:skip+size], position)
+	s.mutex.Lock()
+	if end := position + int64(n); end > s.position {
+		s.position = end
+	}
+	if s.position > s.end {
+		// split while writing, the rest belongs to the new segment, which gets the same data
+		s.position = s.end
 	}
-	size, err = s.dst.WriteAt(b[:size], s.position)
-	s.position += int64(size)
-	return size, err
+	s.mutex.Unlock()
+	return skip + n, err
 }
 
 func (s *Segment) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return fmt.Sprintf("%d-%d-%d", s.begin, s.position, s.end)
 }
 
 // Readable .
 func (s *Segment) Readable() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.readable()
+}
+
+func (s *Segment) readable() string {
 	return fmt.Sprintf("%d: %s - %s(%s)", s.jobid, SizeToReadable(float64(s.begin)),
 		SizeToReadable(float64(s.position)), SizeToReadable(float64(s.end)))
 }
 
 // Begin .
 func (s *Segment) Begin() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.begin
 }
 
 // Current .
 func (s *Segment) Current() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.position
 }
 
 // End .
 func (s *Segment) End() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.end
 }
 
 // Length .
 func (s *Segment) Length() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.end - s.begin
 }
 
 // Remaining .
 func (s *Segment) Remaining() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.end - s.position
 }
 
 // Written .
 func (s *Segment) Written() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.position - s.begin
 }
 
 // Finish .
 func (s *Segment) Finish() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.position >= s.end
 }
 
 // Active .
 func (s *Segment) Active() bool {
-	return !s.Finish() && s.jobid != 0
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.position < s.end && s.jobid != 0
 }
 
 // Start .
 func (s *Segment) Start(jobid int, dst io.WriterAt) error {
-	if s.JobId() > 0 {
-		logrus.Debugf("segment %s already start", s.Readable())
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.jobid > 0 {
+		logrus.Debugf("segment %s already start", s.readable())
 		return ErrSegmentStarted
 	}
 	if jobid <= 0 {
-		logrus.Debugf("segment %s start invalid job id %d", s.Readable(), jobid)
+		logrus.Debugf("segment %s start invalid job id %d", s.readable(), jobid)
 		return ErrInvalidJobId
 	}
 	s.jobid = jobid
 	s.dst = dst
-	logrus.Infof("segment %s start", s.Readable())
+	logrus.Debugf("segment %s start", s.readable())
 	return nil
 }
 
+// Release detaches the segment from its job, so another job can continue it.
+func (s *Segment) Release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.jobid = 0
+	s.attempt = 0
+}
+
 // JobId .
 func (s *Segment) JobId() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.jobid
 }
 
 // Split .
 func (s *Segment) Split() *Segment {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	mid := s.position + (s.end-s.position)/2
 	seg := NewSegment(mid, s.end)
 	s.end = mid
@@ -168,30 +269,34 @@ func (s *Segment) Split() *Segment {
 
 // Cross .
 func (s *Segment) Cross(seg *Segment) bool {
-	return s.begin >= seg.begin && s.begin < seg.end || s.end <= seg.end && s.end > seg.begin
+	begin, end := s.Begin(), s.End()
+	return begin >= seg.Begin() && begin < seg.End() || end <= seg.End() && end > seg.Begin()
 }
 
 // Connected .
 func (s *Segment) Connected(seg *Segment) bool {
-	return s.begin == seg.end || s.end == seg.begin
+	return s.Begin() == seg.End() || s.End() == seg.Begin()
 }
 
 // Contain .
 func (s *Segment) Contain(seg *Segment) bool {
-	return s.begin <= seg.begin && seg.end <= s.end
+	return s.Begin() <= seg.Begin() && seg.End() <= s.End()
 }
 
 // Merge .
 func (s *Segment) Merge(seg *Segment) {
 	if s.Finish() && seg.Finish() {
 		if s.Connected(seg) || s.Cross(seg) || s.Contain(seg) || seg.Contain(s) {
-			if s.begin > seg.begin {
-				s.begin = seg.begin
+			begin, end := seg.Begin(), seg.End()
+			s.mutex.Lock()
+			if s.begin > begin {
+				s.begin = begin
 			}
-			if s.end < seg.end {
-				s.end = seg.end
+			if s.end < end {
+				s.end = end
 			}
 			s.position = s.end
+			s.mutex.Unlock()
 		} else {
 			panic(fmt.Errorf("Connot merge uncross segment, %s + %s", s.Readable(), seg.Readable()))
 		}
@@ -200,6 +305,61 @@ func (s *Segment) Merge(seg *Segment) {
 	}
 }
 
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Begin, r.End)
+}
+
+// Length .
+func (r ByteRange) Length() int64 {
+	return r.End - r.Begin
+}
+
+// MergeRanges .
+func MergeRanges(ranges []ByteRange) []ByteRange {
+	ranges = append([]ByteRange(nil), ranges...)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Begin < ranges[j].Begin
+	})
+	merged := make([]ByteRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.End <= r.Begin {
+			continue
+		}
+		if last := len(merged) - 1; last >= 0 && r.Begin <= merged[last].End {
+			if r.End > merged[last].End {
+				merged[last].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// SubtractRanges .
+func SubtractRanges(ranges, sub []ByteRange) []ByteRange {
+	ranges, sub = MergeRanges(ranges), MergeRanges(sub)
+	result := make([]ByteRange, 0, len(ranges))
+	for _, r := range ranges {
+		for _, s := range sub {
+			if s.End <= r.Begin || s.Begin >= r.End {
+				continue
+			}
+			if s.Begin > r.Begin {
+				result = append(result, ByteRange{r.Begin, s.Begin})
+			}
+			r.Begin = s.End
+			if r.Begin >= r.End {
+				break
+			}
+		}
+		if r.Begin < r.End {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
 // NewSegments .
 func NewSegments(segs []*Segment) *Segments {
 	return &Segments{
@@ -230,11 +390,19 @@ func SegmentsReadFromByte(b []byte) (*Segments, error) {
 
 // Segments .
 func (s *Segments) Segments() []*Segment {
-	return s.segments
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*Segment(nil), s.segments...)
 }
 
 // CleanOverlap .
 func (s *Segments) CleanOverlap() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cleanOverlap()
+}
+
+func (s *Segments) cleanOverlap() {
 	newSegments := make([]*Segment, 0, len(s.segments))
 	sort.Slice(s.segments, func(i, j int) bool {
 		if s.segments[i].Begin() == s.segments[j].Begin() {
@@ -243,25 +411,27 @@ func (s *Segments) CleanOverlap() {
 		return s.segments[i].Begin() < s.segments[j].Begin()
 	})
 
+	// finished segments are merged into new segments, as their jobs may still hold them
 	finish := NewSegment(0, 0)
 	for _, seg := range s.segments {
 		if seg.Finish() {
-			if seg.Begin() <= finish.End() {
-				if seg.End() > finish.End() {
-					finish.end = seg.End()
-					finish.position = seg.End()
+			if seg.Begin() <= finish.end {
+				if end := seg.End(); end > finish.end {
+					finish.end = end
+					finish.position = end
 				}
 			} else {
-				if finish.End() > finish.Begin() {
+				if finish.end > finish.begin {
 					newSegments = append(newSegments, finish)
 				}
-				finish = seg
+				finish = NewSegment(seg.Begin(), seg.End())
+				finish.position = finish.end
 			}
 			continue
 		}
 		newSegments = append(newSegments, seg)
 	}
-	if finish.End() > finish.Begin() {
+	if finish.end > finish.begin {
 		newSegments = append(newSegments, finish)
 	}
 	s.segments = newSegments
@@ -269,7 +439,9 @@ func (s *Segments) CleanOverlap() {
 
 // ToByte .
 func (s *Segments) ToByte() []byte {
-	s.CleanOverlap()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cleanOverlap()
 	buffer := bytes.NewBuffer(nil)
 	for index, segment := range s.segments {
 		if index > 0 {
@@ -282,6 +454,12 @@ func (s *Segments) ToByte() []byte {
 
 // Readable .
 func (s *Segments) Readable() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.readable()
+}
+
+func (s *Segments) readable() string {
 	buffer := bytes.NewBuffer(nil)
 	for index, segment := range s.segments {
 		if index > 0 {
@@ -298,6 +476,8 @@ func (s *Segments) String() string {
 
 // Write .
 func (s *Segments) Write(jobid int, b []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if jobid <= 0 {
 		return 0, ErrInvalidJobId
 	}
@@ -306,17 +486,21 @@ func (s *Segments) Write(jobid int, b []byte) (int, error) {
 			return seg.Write(b)
 		}
 	}
-	logrus.Debugf("Can't' write to job %d with size %d, segments: %s", jobid, len(b), s.Readable())
+	logrus.Debugf("Can't' write to job %d with size %d, segments: %s", jobid, len(b), s.readable())
 	return 0, ErrAllSegmentIsFinish
 }
 
 // Remove .
 func (s *Segments) Remove(begin, end int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.segments = append(s.segments, NewSegment(begin, end))
 }
 
 // Start .
 func (s *Segments) Start(jobId int, dst io.WriterAt) (*Segment, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if jobId <= 0 {
 		return nil, ErrInvalidJobId
 	}
@@ -348,13 +532,30 @@ func (s *Segments) Start(jobId int, dst io.WriterAt) (*Segment, error) {
 
 // InitSize .
 func (s *Segments) InitSize(length int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if len(s.segments) == 0 {
 		s.segments = append(s.segments, NewSegment(0, length))
 	}
 }
 
+// Completed .
+func (s *Segments) Completed() []ByteRange {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	done := make([]ByteRange, 0, len(s.segments))
+	pending := make([]ByteRange, 0, len(s.segments))
+	for _, seg := range s.segments {
+		done = append(done, ByteRange{seg.Begin(), seg.Current()})
+		pending = append(pending, ByteRange{seg.Current(), seg.End()})
+	}
+	return SubtractRanges(done, pending)
+}
+
 // Remaining .
 func (s *Segments) Remaining() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	sum := int64(0)
 	for _, seg := range s.segments {
 		sum += seg.Remaining()
@@ -3,6 +3,7 @@ package downloader
 import (
 	"bytes"
 	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -22,6 +23,18 @@ func (buff *WriteAtBuffer) Bytes() []byte {
 	return buff.buffer
 }
 
+// lockedBuffer allows overlapped writes, which are identical, from concurrent jobs.
+type lockedBuffer struct {
+	sync.Mutex
+	WriteAtBuffer
+}
+
+func (buff *lockedBuffer) WriteAt(b []byte, offset int64) (int, error) {
+	buff.Lock()
+	defer buff.Unlock()
+	return buff.WriteAtBuffer.WriteAt(b, offset)
+}
+
 type Range struct {
 	Begin int64
 	End   int64
@@ -54,6 +67,86 @@ func TestSegment(t *testing.T) {
 	}
 }
 
+func TestSegmentWriteAt(t *testing.T) {
+	src := make([]byte, 100)
+	rand.Read(src)
+	dst := &WriteAtBuffer{buffer: make([]byte, 100)}
+	seg := NewSegment(0, 100)
+	if _, err := seg.WriteAt(src[:10], 0); err != ErrSegmentNotActive {
+		t.Errorf("Expect inactive segment, got %v", err)
+	}
+	seg.Start(1, dst)
+
+	cases := []struct {
+		begin, end int64
+		n          int
+		err        error
+		position   int64
+	}{
+		{0, 40, 40, nil, 40},
+		{20, 60, 40, nil, 60}, // restarted job overlaps the written part
+		{10, 30, 20, nil, 60}, // written already
+		{80, 90, 0, ErrSegmentGap, 60},
+	}
+	for _, c := range cases {
+		n, err := seg.WriteAt(src[c.begin:c.end], c.begin)
+		if n != c.n || err != c.err || seg.Current() != c.position {
+			t.Errorf("WriteAt %d-%d: n = %d, err = %v, position = %d", c.begin, c.end, n, err, seg.Current())
+		}
+	}
+
+	// split while the job writes past the new end
+	tail := seg.Split()
+	if n, err := seg.WriteAt(src[60:], 60); n != 20 || err != nil || !seg.Finish() {
+		t.Errorf("Unexpected write after split: n = %d, err = %v, segment %s", n, err, seg)
+	}
+	if _, err := seg.WriteAt(src[80:], 80); err != ErrSegmentFinish {
+		t.Errorf("Expect finished segment, got %v", err)
+	}
+	tail.Start(2, dst)
+	tail.WriteAt(src[tail.Begin():], tail.Begin())
+	if !bytes.Equal(src, dst.Bytes()) {
+		t.Error("Copy error")
+	}
+
+	// concurrent jobs on one segment, while it is split and inspected
+	size := 1024 * 1024
+	src = make([]byte, size)
+	rand.Read(src)
+	locked := &lockedBuffer{WriteAtBuffer: WriteAtBuffer{buffer: make([]byte, size)}}
+	segs := NewSegments(nil)
+	segs.InitSize(int64(size))
+	seg, _ = segs.Start(1, locked)
+	var wg sync.WaitGroup
+	write := func(seg *Segment) {
+		defer wg.Done()
+		for off := seg.Current(); off < int64(size); off += 1000 {
+			end := off + 1000
+			if end > int64(size) {
+				end = int64(size)
+			}
+			if _, err := seg.WriteAt(src[off:end], off); err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go write(seg)
+	go write(seg)
+	for i := 2; i < 6; i++ {
+		if s, _ := segs.Start(i, locked); s != nil {
+			wg.Add(1)
+			go write(s)
+		}
+		segs.Remaining()
+		segs.ToByte()
+	}
+	wg.Wait()
+	if segs.Remaining() != 0 || !bytes.Equal(src, locked.Bytes()) {
+		t.Errorf("Unexpected concurrent write, segments %s", segs)
+	}
+}
+
 func TestMultiSegments(t *testing.T) {
 	size := 1024 * 1024 * 200
 	thread := 16
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package downloader
+
+import (
+	"errors"
+	"os"
+)
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space is unknown")
+}
+
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
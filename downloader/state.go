@@ -0,0 +1,175 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StateVersion .
+const StateVersion = 1
+
+var (
+	ErrStateVersion = errors.New("Unsupported State Version")
+	ErrStateCorrupt = errors.New("State Checksum Mismatch")
+)
+
+// State .
+type State struct {
+	Version   int
+	URLs      []string
+	Validator Validator
+	Segments  *Segments
+	// Suspect are the resumed ranges to re-download after a checksum mismatch
+	Suspect   []ByteRange
+	CreatedAt time.Time
+}
+
+type stateSegment struct {
+	Begin    int64 `json:"begin"`
+	Position int64 `json:"position"`
+	End      int64 `json:"end"`
+}
+
+type stateRange struct {
+	Begin int64 `json:"begin"`
+	End   int64 `json:"end"`
+}
+
+type stateFile struct {
+	Version       int            `json:"version"`
+	URLs          []string       `json:"urls"`
+	ContentLength int64          `json:"content_length"`
+	ETag          string         `json:"etag,omitempty"`
+	LastModified  string         `json:"last_modified,omitempty"`
+	Segments      []stateSegment `json:"segments"`
+	Suspect       []stateRange   `json:"suspect,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Checksum      string         `json:"checksum"`
+}
+
+// NewState .
+func NewState(urls ...string) *State {
+	return &State{
+		Version:   StateVersion,
+		URLs:      urls,
+		Segments:  NewSegments(nil),
+		CreatedAt: time.Now(),
+	}
+}
+
+// StateReadFromByte .
+func StateReadFromByte(b []byte) (*State, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return NewState(), nil
+	}
+	if b[0] != '{' {
+		return legacyStateReadFromByte(b)
+	}
+
+	f := &stateFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("Parse state error: %v", err)
+	}
+	if f.Version < 1 || f.Version > StateVersion {
+		return nil, fmt.Errorf("%w: %d", ErrStateVersion, f.Version)
+	}
+	checksum := f.Checksum
+	if f.sum() != checksum {
+		return nil, ErrStateCorrupt
+	}
+
+	segs := make([]*Segment, 0, len(f.Segments))
+	for _, seg := range f.Segments {
+		if seg.Begin > seg.Position || seg.Position > seg.End {
+			return nil, fmt.Errorf("%w: %d-%d-%d", ErrWrongSegmentFormat, seg.Begin, seg.Position, seg.End)
+		}
+		segs = append(segs, &Segment{begin: seg.Begin, position: seg.Position, end: seg.End})
+	}
+	var suspect []ByteRange
+	for _, r := range f.Suspect {
+		suspect = append(suspect, ByteRange{r.Begin, r.End})
+	}
+	return &State{
+		Version: f.Version,
+		URLs:    f.URLs,
+		Validator: Validator{
+			ETag:         f.ETag,
+			LastModified: f.LastModified,
+			Length:       f.ContentLength,
+		},
+		Segments:  NewSegments(segs),
+		Suspect:   suspect,
+		CreatedAt: f.CreatedAt,
+	}, nil
+}
+
+// legacyStateReadFromByte reads the plain segment list, optionally followed by validator header lines.
+func legacyStateReadFromByte(b []byte) (*State, error) {
+	lines := strings.Split(string(b), "\n")
+	segments, err := SegmentsReadFromByte([]byte(lines[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewState()
+	s.Segments = segments
+	for _, line := range lines[1:] {
+		index := strings.Index(line, ":")
+		if index < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[index+1:])
+		switch strings.TrimSpace(line[:index]) {
+		case "ETag":
+			s.Validator.ETag = value
+		case "Last-Modified":
+			s.Validator.LastModified = value
+		case "Content-Length":
+			s.Validator.Length, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Parse state error: line = %s, err = %v", line, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// ToByte .
+func (s *State) ToByte() []byte {
+	f := &stateFile{
+		Version:       StateVersion,
+		URLs:          s.URLs,
+		ContentLength: s.Validator.Length,
+		ETag:          s.Validator.ETag,
+		LastModified:  s.Validator.LastModified,
+		Segments:      []stateSegment{},
+		CreatedAt:     s.CreatedAt,
+	}
+	s.Segments.CleanOverlap()
+	for _, seg := range s.Segments.Segments() {
+		f.Segments = append(f.Segments, stateSegment{Begin: seg.Begin(), Position: seg.Current(), End: seg.End()})
+	}
+	for _, r := range s.Suspect {
+		f.Suspect = append(f.Suspect, stateRange{r.Begin, r.End})
+	}
+	f.Checksum = f.sum()
+
+	b, _ := json.MarshalIndent(f, "", "  ")
+	return b
+}
+
+func (f *stateFile) sum() string {
+	cp := *f
+	cp.Checksum = ""
+	b, _ := json.Marshal(&cp)
+	hash := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	state := NewState("http://example.com/a", "http://mirror.example.com/a")
+	state.Validator = Validator{ETag: `"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT", Length: 300}
+	state.Segments = NewSegments([]*Segment{NewSegment(0, 100), {begin: 100, position: 150, end: 300}})
+
+	b := state.ToByte()
+	read, err := StateReadFromByte(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Version != StateVersion || len(read.URLs) != 2 || read.URLs[1] != "http://mirror.example.com/a" {
+		t.Errorf("Unexpected state header: %+v", read)
+	}
+	if read.Validator != state.Validator {
+		t.Errorf("Validator mismatch: %+v != %+v", read.Validator, state.Validator)
+	}
+	if !read.CreatedAt.Equal(state.CreatedAt) {
+		t.Errorf("CreatedAt mismatch: %v != %v", read.CreatedAt, state.CreatedAt)
+	}
+	if read.Segments.String() != state.Segments.String() {
+		t.Errorf("Segments mismatch: %s != %s", read.Segments, state.Segments)
+	}
+	if !bytes.Equal(read.ToByte(), b) {
+		t.Errorf("State is not stable:\n%s\n%s", read.ToByte(), b)
+	}
+}
+
+func TestStateLegacy(t *testing.T) {
+	legacy := []byte("0-100-100,100-150-300")
+	segments, _ := SegmentsReadFromByte(legacy)
+	state, err := StateReadFromByte(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Segments.String() != segments.String() || !state.Validator.Empty() {
+		t.Errorf("Unexpected legacy state: %s %+v", state.Segments, state.Validator)
+	}
+
+	state, err = StateReadFromByte([]byte("0-100-100\nETag: \"abc\"\nContent-Length: 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Validator.ETag != `"abc"` || state.Validator.Length != 100 {
+		t.Errorf("Unexpected legacy validator: %+v", state.Validator)
+	}
+
+	migrated, err := StateReadFromByte(state.ToByte())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Version != StateVersion || migrated.Validator != state.Validator {
+		t.Errorf("Unexpected migrated state: %+v", migrated)
+	}
+}
+
+func TestStateInvalid(t *testing.T) {
+	b := NewState("http://example.com/a").ToByte()
+	_, err := StateReadFromByte(bytes.Replace(b, []byte("example.com"), []byte("example.org"), 1))
+	if !errors.Is(err, ErrStateCorrupt) {
+		t.Errorf("Expect %v, got %v", ErrStateCorrupt, err)
+	}
+
+	_, err = StateReadFromByte(bytes.Replace(b, []byte(`"version": 1`), []byte(`"version": 99`), 1))
+	if !errors.Is(err, ErrStateVersion) {
+		t.Errorf("Expect %v, got %v", ErrStateVersion, err)
+	}
+}
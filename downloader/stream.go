@@ -0,0 +1,208 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	StreamThreads       = 8
+	StreamChunk   int64 = 1024 * 1024
+	// StreamBuffer bounds the bytes downloaded ahead of the reader
+	StreamBuffer int64 = 32 * 1024 * 1024
+)
+
+// Stream reads a remote file in order, while chunks ahead are downloaded by parallel range requests.
+type Stream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	chunks  []*chunk
+	window  chan struct{}
+	current int
+	offset  int
+}
+
+type chunk struct {
+	begin int64
+	end   int64
+	data  []byte
+	err   error
+	done  chan struct{}
+}
+
+// Open .
+func (d *Downloader) Open(ctx context.Context, req *http.Request) (io.ReadCloser, error) {
+	return d.OpenStream(ctx, req, StreamThreads)
+}
+
+// OpenStream returns the remote file as an in-order reader, it falls back to one request if range is unsupported.
+func (d *Downloader) OpenStream(ctx context.Context, req *http.Request, threadCount int) (io.ReadCloser, error) {
+	remote, err := d.DetectRemoteContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !remote.Range || threadCount <= 1 || remote.Length <= StreamChunk {
+		return d.openSingle(ctx, req)
+	}
+
+	request := req.Clone(ctx)
+	SetIfRange(request, remote.Validator)
+	return d.newStream(ctx, request, 0, remote.Length, threadCount), nil
+}
+
+// newStream reads [begin, end) of the request in order, the request should carry If-Range.
+func (d *Downloader) newStream(ctx context.Context, request *http.Request, begin, end int64, threadCount int) *Stream {
+	window := int(StreamBuffer / StreamChunk)
+	if window < threadCount {
+		window = threadCount
+	}
+	s := &Stream{window: make(chan struct{}, window)}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	for pos := begin; pos < end; pos += StreamChunk {
+		c := &chunk{begin: pos, end: pos + StreamChunk, done: make(chan struct{})}
+		if c.end > end {
+			c.end = end
+		}
+		s.chunks = append(s.chunks, c)
+	}
+
+	// chunks are handed out in order, at most window chunks ahead of the reader
+	queue := make(chan *chunk)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(queue)
+		for _, c := range s.chunks {
+			select {
+			case s.window <- struct{}{}:
+			case <-s.ctx.Done():
+				return
+			}
+			select {
+			case queue <- c:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < threadCount; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for c := range queue {
+				c.err = d.fetchChunk(s.ctx, request, c)
+				close(c.done)
+			}
+		}()
+	}
+	return s
+}
+
+func (d *Downloader) openSingle(ctx context.Context, req *http.Request) (io.ReadCloser, error) {
+	request := req.Clone(ctx)
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return nil, NewRequestError("request", request, 0, 0, err)
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		response.Body.Close()
+		return nil, NewStatusError("request", response, 0, 0)
+	}
+	return &readCloser{Reader: NewRateLimitedReader(ctx, response.Body, d.rateLimiter()), Closer: response.Body}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// fetchChunk downloads the chunk, it retries from where the last try stops.
+func (d *Downloader) fetchChunk(ctx context.Context, req *http.Request, c *chunk) error {
+	policy := d.retryPolicy()
+	c.data = make([]byte, c.end-c.begin)
+	got := 0
+	for failures := 0; ; {
+		n, err := d.fetchRange(ctx, req, c.begin+int64(got), c.data[got:])
+		got += n
+		if n > 0 {
+			failures = 0
+		}
+		if got == len(c.data) {
+			return nil
+		}
+		if err == nil {
+			err = NewRequestError("read", req, c.begin+int64(got), c.end, io.ErrUnexpectedEOF)
+		}
+		failures++
+		if !IsRetryable(err) || errors.Is(err, ErrRemoteChanged) || policy.SegmentRetries > 0 && failures > policy.SegmentRetries {
+			return err
+		}
+		delay := policy.Backoff(failures, RetryAfter(err))
+		logrus.Debugf("Chunk %d-%d error: %v, retry in %s", c.begin, c.end, err, delay)
+		if err = sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Downloader) fetchRange(ctx context.Context, req *http.Request, begin int64, b []byte) (int, error) {
+	request := req.Clone(ctx)
+	end := begin + int64(len(b))
+	SetRange(request, begin, end-1)
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return 0, NewRequestError("request", request, begin, end, err)
+	}
+	defer response.Body.Close()
+	if RemoteChanged(request, response) {
+		return 0, &Error{Op: "request", URL: request.URL.String(), StatusCode: response.StatusCode,
+			Begin: begin, End: end, Err: ErrRemoteChanged}
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		return 0, NewStatusError("request", response, begin, end)
+	}
+	n, err := io.ReadFull(NewRateLimitedReader(ctx, response.Body, d.rateLimiter()), b)
+	if err != nil {
+		return n, NewRequestError("read", request, begin+int64(n), end, err)
+	}
+	return n, nil
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	if s.current >= len(s.chunks) {
+		return 0, io.EOF
+	}
+	c := s.chunks[s.current]
+	select {
+	case <-c.done:
+	case <-s.ctx.Done():
+		return 0, s.ctx.Err()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n := copy(b, c.data[s.offset:])
+	s.offset += n
+	if s.offset == len(c.data) {
+		c.data = nil
+		s.current++
+		s.offset = 0
+		<-s.window
+	}
+	return n, nil
+}
+
+// Close stops the downloads of chunks ahead.
+func (s *Stream) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,106 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type truncatedResponseWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *truncatedResponseWriter) Write(b []byte) (int, error) {
+	if len(b) > w.left {
+		b = b[:w.left]
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.left -= n
+	if w.left <= 0 {
+		return n, io.ErrShortWrite
+	}
+	return n, err
+}
+
+func TestOpenStream(t *testing.T) {
+	chunk, buffer := StreamChunk, StreamBuffer
+	StreamChunk, StreamBuffer = 64*1024, 256*1024
+	defer func() { StreamChunk, StreamBuffer = chunk, buffer }()
+
+	size := int64(5*1024*1024 + 123)
+	src := make([]byte, size)
+	rand.Read(src)
+	modTime := time.Now().Add(-time.Hour)
+
+	var requests, broken int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// break some responses in the middle
+		if r.Method == "GET" && atomic.AddInt32(&requests, 1)%10 == 0 {
+			atomic.AddInt32(&broken, 1)
+			http.ServeContent(&truncatedResponseWriter{ResponseWriter: w, left: 100}, r, "test", modTime, bytes.NewReader(src))
+			return
+		}
+		http.ServeContent(w, r, "test", modTime, bytes.NewReader(src))
+	}))
+	defer server.Close()
+
+	d := NewDefaultDownloader()
+	d.Retry = &RetryPolicy{SegmentRetries: 3, InitialBackoff: time.Millisecond}
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	reader, err := d.Open(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reader.(*Stream); !ok {
+		t.Fatalf("Expect parallel stream, got %T", reader)
+	}
+	b, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+	if broken == 0 {
+		t.Error("Expect broken responses retried")
+	}
+
+	// close before reading everything does not block
+	reader, err = d.Open(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 1000)
+	if _, err = io.ReadFull(reader, head); err != nil || !bytes.Equal(head, src[:1000]) {
+		t.Errorf("Unexpected head: %v", err)
+	}
+	reader.Close()
+}
+
+func TestOpenStreamWithoutRange(t *testing.T) {
+	src := make([]byte, 4*1024*1024)
+	rand.Read(src)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	reader, err := NewDefaultDownloader().Open(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if b, _ := ioutil.ReadAll(reader); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+}
@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrChecksumNotFound = errors.New("Checksum Not Found")
+
+	ChecksumAlgorithms = []string{"sha512", "sha256", "sha1", "md5"}
+	MaxChecksumFile    = int64(1024 * 1024)
+)
+
+// ChecksumAlgorithmFromLength .
+func ChecksumAlgorithmFromLength(hexLen int) string {
+	switch hexLen {
+	case 32:
+		return "md5"
+	case 40:
+		return "sha1"
+	case 64:
+		return "sha256"
+	case 128:
+		return "sha512"
+	}
+	return ""
+}
+
+// ParseChecksumFile parses sha256sum style, BSD style and bare checksum files.
+func ParseChecksumFile(b []byte, name, algorithm string) (*Checksum, error) {
+	var candidates []*Checksum
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var algo, sum, file string
+		if index := strings.Index(line, ") = "); index > 0 && strings.Contains(line[:index], " (") {
+			// SHA256 (file) = hex
+			open := strings.Index(line, " (")
+			algo = strings.Replace(strings.ToLower(line[:open]), "-", "", -1)
+			file = line[open+2 : index]
+			sum = line[index+4:]
+		} else {
+			fields := strings.Fields(line)
+			sum = fields[0]
+			if len(fields) > 1 {
+				file = strings.TrimPrefix(strings.TrimSpace(line[len(sum):]), "*")
+			}
+		}
+
+		if algo == "" {
+			algo = algorithm
+		}
+		if algo == "" {
+			algo = ChecksumAlgorithmFromLength(len(sum))
+		}
+		checksum, err := NewChecksum(algo, sum)
+		if err != nil {
+			logrus.Debugf("Skip checksum line %q: %v", line, err)
+			continue
+		}
+		if file == "" || path.Base(strings.TrimPrefix(file, "./")) == name {
+			if file != "" {
+				return checksum, nil
+			}
+			candidates = append(candidates, checksum)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrChecksumNotFound, name)
+}
+
+// ChecksumURLs returns sidecar and SUMS file locations for a file url, strongest algorithm first.
+func ChecksumURLs(uri *url.URL) []string {
+	base := *uri
+	base.RawQuery, base.Fragment = "", ""
+	dir := base
+	dir.Path, dir.RawPath = path.Dir(base.Path), ""
+	if !strings.HasSuffix(dir.Path, "/") {
+		dir.Path += "/"
+	}
+
+	urls := make([]string, 0, 3*len(ChecksumAlgorithms))
+	for _, algo := range ChecksumAlgorithms {
+		urls = append(urls, base.String()+"."+algo, base.String()+"."+algo+"sum")
+	}
+	for _, algo := range ChecksumAlgorithms {
+		urls = append(urls, dir.String()+strings.ToUpper(algo)+"SUMS")
+	}
+	return urls
+}
+
+// DiscoverChecksumContext .
+func (d *Downloader) DiscoverChecksumContext(ctx context.Context, req *http.Request, checksumURL string) (*Checksum, error) {
+	name := path.Base(req.URL.Path)
+	urls := []string{checksumURL}
+	if checksumURL == "" {
+		urls = ChecksumURLs(req.URL)
+	}
+
+	for _, uri := range urls {
+		b, err := d.fetchChecksumFile(ctx, req, uri)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logrus.Debugf("Probe checksum %s: %v", uri, err)
+			if checksumURL != "" {
+				return nil, err
+			}
+			continue
+		}
+
+		algo := ""
+		lower := strings.ToLower(path.Base(uri))
+		for _, a := range ChecksumAlgorithms {
+			if strings.HasSuffix(lower, "."+a) || strings.HasSuffix(lower, "."+a+"sum") || lower == a+"sums" {
+				algo = a
+			}
+		}
+		checksum, err := ParseChecksumFile(b, name, algo)
+		if err != nil {
+			logrus.Debugf("Parse checksum %s: %v", uri, err)
+			if checksumURL != "" {
+				return nil, err
+			}
+			continue
+		}
+		logrus.Infof("Found checksum %s from %s", checksum, uri)
+		return checksum, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrChecksumNotFound, req.URL)
+}
+
+func (d *Downloader) fetchChecksumFile(ctx context.Context, req *http.Request, uri string) ([]byte, error) {
+	u, err := req.URL.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	request := req.Clone(ctx)
+	request.URL = u
+	request.Host = ""
+	request.Header.Del("Range")
+	request.Header.Del("If-Range")
+	// credentials of the download are not sent to a checksum url on another host
+	if u.Host != req.URL.Host {
+		request.Header.Del("Authorization")
+		request.Header.Del("Cookie")
+	}
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return nil, NewRequestError("checksum", request, 0, 0, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, NewStatusError("checksum", response, 0, 0)
+	}
+	return ioutil.ReadAll(io.LimitReader(response.Body, MaxChecksumFile))
+}
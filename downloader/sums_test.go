@@ -0,0 +1,127 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	sha := sha256.Sum256([]byte("gget"))
+	md := md5.Sum([]byte("gget"))
+	cases := []struct {
+		content   string
+		algorithm string
+		expect    string
+	}{
+		{fmt.Sprintf("%x\n", sha), "", fmt.Sprintf("sha256:%x", sha)},
+		{fmt.Sprintf("%x  other.tar.gz\n%x  gget.tar.gz\n", md, sha), "sha256", fmt.Sprintf("sha256:%x", sha)},
+		{fmt.Sprintf("%x *./dist/gget.tar.gz\n", md), "", fmt.Sprintf("md5:%x", md)},
+		{fmt.Sprintf("# comment\nSHA256 (gget.tar.gz) = %x\n", sha), "", fmt.Sprintf("sha256:%x", sha)},
+	}
+	for _, c := range cases {
+		checksum, err := ParseChecksumFile([]byte(c.content), "gget.tar.gz", c.algorithm)
+		if err != nil {
+			t.Errorf("Parse %q: %v", c.content, err)
+		} else if checksum.String() != c.expect {
+			t.Errorf("Parse %q: expect %s, got %s", c.content, c.expect, checksum)
+		}
+	}
+
+	_, err := ParseChecksumFile([]byte(fmt.Sprintf("%x  other.tar.gz\n", sha)), "gget.tar.gz", "")
+	if !errors.Is(err, ErrChecksumNotFound) {
+		t.Errorf("Expect %v, got %v", ErrChecksumNotFound, err)
+	}
+}
+
+func TestChecksumURLs(t *testing.T) {
+	u, _ := url.Parse("https://example.com/release/gget.tar.gz?token=1")
+	urls := ChecksumURLs(u)
+	expect := map[string]bool{
+		"https://example.com/release/gget.tar.gz.sha256": false,
+		"https://example.com/release/gget.tar.gz.md5":    false,
+		"https://example.com/release/SHA256SUMS":         false,
+	}
+	for _, uri := range urls {
+		if _, ok := expect[uri]; ok {
+			expect[uri] = true
+		}
+	}
+	for uri, found := range expect {
+		if !found {
+			t.Errorf("Missing %s in %v", uri, urls)
+		}
+	}
+}
+
+func TestDownloadFileDiscoverChecksum(t *testing.T) {
+	size := int64(1024 * 1024)
+	src, filename, cleanup := newTestFile(t, size, "file")
+	defer cleanup()
+	sums := fmt.Sprintf("%x  gget.bin\n", sha256.Sum256(src))
+
+	modTime := time.Now().Add(-time.Hour)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/release/gget.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "gget.bin", modTime, bytes.NewReader(src))
+	})
+	mux.HandleFunc("/release/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sums))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"/release/gget.bin", nil)
+	d := NewDefaultDownloader()
+	d.ChecksumDiscovery = true
+	if err := d.DownloadFile(request, 4, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filename); !bytes.Equal(b, src) {
+		t.Error("Content mismatch")
+	}
+
+	sums = fmt.Sprintf("%x  gget.bin\n", sha256.Sum256(nil))
+	os.Remove(filename)
+	os.Remove(filename + ".state")
+	if err := d.DownloadFile(request, 1, filename); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expect %v, got %v", ErrChecksumMismatch, err)
+	}
+}
+
+func TestDiscoverChecksumCredentials(t *testing.T) {
+	sum := sha256.Sum256([]byte("gget"))
+	var auth int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			atomic.StoreInt32(&auth, 1)
+		}
+		fmt.Fprintf(w, "%x  gget.bin\n", sum)
+	}))
+	defer server.Close()
+
+	// credentials of the download are not sent to the checksum url on another host
+	request, _ := http.NewRequest("GET", "http://example.com/release/gget.bin", nil)
+	request.SetBasicAuth("user", "pass")
+	checksum, err := NewDefaultDownloader().DiscoverChecksumContext(context.Background(), request, server.URL+"/SHA256SUMS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checksum.Sum, sum[:]) {
+		t.Errorf("Unexpected checksum %s", checksum)
+	}
+	if atomic.LoadInt32(&auth) != 0 {
+		t.Error("Credentials are sent to the checksum url on another host")
+	}
+}
@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	TerminalWidth = 80
+
+	segmentJobChars = "123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+// TerminalProgress renders a live progress bar and a map of segments, it redraws its lines in place.
+type TerminalProgress struct {
+	mutex sync.Mutex
+	w     io.Writer
+	width int
+	lines int
+}
+
+// NewTerminalProgress .
+func NewTerminalProgress(w io.Writer) *TerminalProgress {
+	width := TerminalWidth
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 20 {
+		width = columns
+	}
+	return &TerminalProgress{w: w, width: width}
+}
+
+// IsTerminal .
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// OnEvent .
+func (p *TerminalProgress) OnEvent(event Event) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch event.Type {
+	case EventStarted, EventResumed, EventProgress:
+		if segmentMap := p.segmentMap(event); segmentMap != "" {
+			p.draw(p.status(event), segmentMap)
+		} else {
+			p.draw(p.status(event))
+		}
+	case EventFinished:
+		p.draw(p.status(event))
+		p.lines = 0
+	case EventFailed:
+		p.draw(fmt.Sprintf("%s: failed: %v", event.Filename, event.Err))
+		p.lines = 0
+	}
+}
+
+// Write clears the progress lines before writing b, so logs can share the terminal, e.g. logrus.SetOutput.
+func (p *TerminalProgress) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.lines > 0 {
+		fmt.Fprintf(p.w, "\x1b[%dA\r\x1b[J", p.lines)
+		p.lines = 0
+	}
+	return p.w.Write(b)
+}
+
+func (p *TerminalProgress) draw(lines ...string) {
+	var b strings.Builder
+	if p.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", p.lines)
+	}
+	for _, line := range lines {
+		if len(line) > p.width {
+			line = line[:p.width]
+		}
+		fmt.Fprintf(&b, "\r\x1b[K%s\n", line)
+	}
+	// clear the map line left by a previous draw
+	for i := len(lines); i < p.lines; i++ {
+		b.WriteString("\r\x1b[K\n")
+	}
+	if extra := p.lines - len(lines); extra > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", extra)
+	}
+	p.lines = len(lines)
+	io.WriteString(p.w, b.String())
+}
+
+func (p *TerminalProgress) status(event Event) string {
+	eta := "-"
+	if event.ETA >= 0 {
+		eta = event.ETA.Round(time.Second).String()
+	}
+	info := fmt.Sprintf(" %s/s ETA %s", SizeToReadable(event.Speed), eta)
+	if event.Type == EventFinished {
+		info = fmt.Sprintf(" done in %s", event.Elapsed.Round(time.Second))
+	}
+	if event.Connections > 1 {
+		info += fmt.Sprintf(" [%d conn]", event.Connections)
+	}
+	if event.Retries > 0 {
+		info += fmt.Sprintf(" [%d retries]", event.Retries)
+	}
+
+	if event.Total <= 0 {
+		return fmt.Sprintf("%s %s%s", event.Filename, SizeToReadable(float64(event.Done)), info)
+	}
+	percentage := float64(event.Done) * 100 / float64(event.Total)
+	size := fmt.Sprintf(" %5.1f%% %s / %s", percentage, SizeToReadable(float64(event.Done)), SizeToReadable(float64(event.Total)))
+
+	name := event.Filename
+	barWidth := p.width - len(size) - len(info) - 3 - 20
+	if barWidth < 10 {
+		barWidth = 10
+	}
+	if len(name) > 20 {
+		name = name[:17] + "..."
+	}
+	filled := int(float64(barWidth) * float64(event.Done) / float64(event.Total))
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+	if filled > 0 && filled < barWidth {
+		bar = bar[:filled-1] + ">" + bar[filled:]
+	}
+	return fmt.Sprintf("%-20s [%s]%s%s", name, bar, size, info)
+}
+
+// segmentMap draws every cell of the file as done '#', pending '.', or the job char filling it.
+func (p *TerminalProgress) segmentMap(event Event) string {
+	if event.Total <= 0 || len(event.Segments) == 0 {
+		return ""
+	}
+	width := p.width - 2
+	cells := make([]byte, width)
+	done := make([]ByteRange, 0, len(event.Segments))
+	pending := make([]ByteRange, 0, len(event.Segments))
+	for _, seg := range event.Segments {
+		done = append(done, ByteRange{seg.Begin, seg.Current})
+		pending = append(pending, ByteRange{seg.Current, seg.End})
+	}
+	done = SubtractRanges(done, pending)
+
+	for i := range cells {
+		begin := event.Total * int64(i) / int64(width)
+		end := event.Total * int64(i+1) / int64(width)
+		cells[i] = '.'
+		covered := int64(0)
+		for _, r := range done {
+			if r.Begin < end && r.End > begin {
+				covered += min64(r.End, end) - max64(r.Begin, begin)
+			}
+		}
+		if covered >= end-begin {
+			cells[i] = '#'
+			continue
+		}
+		for _, seg := range event.Segments {
+			if seg.Active && seg.Current >= begin && seg.Current < end {
+				cells[i] = segmentJobChars[(seg.JobId-1)%len(segmentJobChars)]
+				break
+			}
+		}
+		if cells[i] == '.' && covered > 0 {
+			cells[i] = '+'
+		}
+	}
+	return "[" + string(cells) + "]"
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
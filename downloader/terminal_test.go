@@ -0,0 +1,47 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTerminalProgress(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	p := NewTerminalProgress(buffer)
+	p.width = 80
+
+	p.OnEvent(Event{Type: EventProgress, Progress: Progress{
+		Filename: "file", Done: 50, Total: 100, Speed: 10, ETA: 5 * time.Second, Connections: 2,
+		Segments: []SegmentProgress{
+			{Begin: 0, Current: 25, End: 50, JobId: 1, Active: true},
+			{Begin: 50, Current: 75, End: 100, JobId: 2, Active: true},
+		},
+	}})
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expect 2 lines, got %q", buffer.String())
+	}
+	if !strings.Contains(lines[0], "50.0%") || !strings.Contains(lines[0], "ETA 5s") {
+		t.Errorf("Unexpected status %q", lines[0])
+	}
+	segmentMap := strings.TrimPrefix(lines[1], "\r\x1b[K")
+	if len(segmentMap) != 80 || !strings.HasPrefix(segmentMap, "[###") || strings.Count(segmentMap, "1") != 1 ||
+		strings.Count(segmentMap, "2") != 1 || strings.Index(segmentMap, "1") > strings.Index(segmentMap, ".") {
+		t.Errorf("Unexpected segment map %q", segmentMap)
+	}
+
+	buffer.Reset()
+	p.Write([]byte("log\n"))
+	if !strings.HasPrefix(buffer.String(), "\x1b[2A") || !strings.HasSuffix(buffer.String(), "log\n") {
+		t.Errorf("Progress lines are not cleared before log: %q", buffer.String())
+	}
+
+	buffer.Reset()
+	p.OnEvent(Event{Type: EventFailed, Progress: Progress{Filename: "file"}, Err: errors.New("broken")})
+	if !strings.Contains(buffer.String(), "failed: broken") {
+		t.Errorf("Unexpected failure %q", buffer.String())
+	}
+}
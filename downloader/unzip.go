@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrUnsafeMember      = errors.New("Unsafe Member Path")
+	ErrUnsupportedMethod = errors.New("Unsupported Compression Method")
+
+	// UnzipParallelSize is the compressed size from which a member is fetched by parallel range requests
+	UnzipParallelSize int64 = 4 * 1024 * 1024
+)
+
+// MatchMember reports whether the zip member matches any pattern, by path.Match on the full name or the base name,
+// or as a directory prefix. Every member matches empty patterns.
+func MatchMember(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+		if dir := strings.TrimSuffix(pattern, "/"); dir != "" && strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// memberPath returns the local path of the member under dir, it rejects members escaping dir.
+func memberPath(dir, name string) (string, error) {
+	clean := path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))
+	if clean == "/" || clean != "/"+strings.TrimSuffix(name, "/") {
+		return "", fmt.Errorf("%w: %q", ErrUnsafeMember, name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean[1:])), nil
+}
+
+// Unzip .
+func (d *Downloader) Unzip(req *http.Request, patterns []string, threadCount int) ([]string, error) {
+	return d.UnzipContext(context.Background(), req, patterns, threadCount)
+}
+
+// UnzipContext extracts the members matching patterns from a remote zip into d.Directory, and returns the extracted files.
+// Only the central directory and the matched members are downloaded.
+func (d *Downloader) UnzipContext(ctx context.Context, req *http.Request, patterns []string, threadCount int) ([]string, error) {
+	f, err := d.OpenRemoteFile(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	// newer go returns the reader along with an error for insecure paths, which are rejected by memberPath
+	reader, err := zip.NewReader(f, f.Size())
+	if reader == nil {
+		return nil, &Error{Op: "unzip", URL: req.URL.String(), Err: err}
+	}
+
+	extracted := []string{}
+	for _, member := range reader.File {
+		if !MatchMember(member.Name, patterns) {
+			continue
+		}
+		filename, err := memberPath(d.Directory, member.Name)
+		if err != nil {
+			return extracted, &Error{Op: "unzip", URL: req.URL.String(), Err: err}
+		}
+		if strings.HasSuffix(member.Name, "/") {
+			if err = os.MkdirAll(filename, 0755); err != nil {
+				return extracted, &Error{Op: "mkdir", Err: err}
+			}
+			continue
+		}
+		filename, skip, err := d.resolveConflict(filename)
+		if err != nil {
+			return extracted, err
+		}
+		if skip {
+			continue
+		}
+		if err = d.extractMember(ctx, f, member, filename, threadCount); err != nil {
+			return extracted, &Error{Op: "unzip", URL: req.URL.String(), Err: fmt.Errorf("%s: %w", member.Name, err)}
+		}
+		extracted = append(extracted, filename)
+	}
+	if len(extracted) == 0 && len(patterns) > 0 {
+		logrus.Warnf("No member matches %v", patterns)
+	}
+	return extracted, nil
+}
+
+func (d *Downloader) extractMember(ctx context.Context, f *RemoteFile, member *zip.File, filename string, threadCount int) error {
+	logrus.Infof("Extract %s (%d bytes) to %s", member.Name, member.UncompressedSize64, filename)
+	reader, err := d.openMember(ctx, f, member, threadCount)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// an existing file is only replaced after the member is extracted and verified
+	part := filename + PartSuffix
+	file, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(file, hash), reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && (uint64(n) != member.UncompressedSize64 || hash.Sum32() != member.CRC32) {
+		err = zip.ErrChecksum
+	}
+	if err == nil {
+		err = os.Rename(part, filename)
+	}
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	if !member.Modified.IsZero() {
+		os.Chtimes(filename, member.Modified, member.Modified)
+	}
+	return nil
+}
+
+// openMember reads a large member by parallel range requests of its compressed data, a small one through the block cache.
+func (d *Downloader) openMember(ctx context.Context, f *RemoteFile, member *zip.File, threadCount int) (io.ReadCloser, error) {
+	size := int64(member.CompressedSize64)
+	if threadCount <= 1 || size < UnzipParallelSize {
+		return member.Open()
+	}
+	offset, err := member.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Debugf("Fetch %s at %d-%d with %d threads", member.Name, offset, offset+size, threadCount)
+	stream := d.newStream(ctx, f.request, offset, offset+size, threadCount)
+	switch member.Method {
+	case zip.Store:
+		return stream, nil
+	case zip.Deflate:
+		return &readCloser{Reader: flate.NewReader(stream), Closer: stream}, nil
+	}
+	stream.Close()
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedMethod, member.Method)
+}
@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUnzip(t *testing.T) {
+	chunk, parallel := StreamChunk, UnzipParallelSize
+	StreamChunk, UnzipParallelSize = 64*1024, 256*1024
+	defer func() { StreamChunk, UnzipParallelSize = chunk, parallel }()
+
+	stored := make([]byte, 1024*1024)
+	rand.Read(stored)
+	deflated := bytes.Repeat([]byte("compressible content "), 100000)
+	skipped := make([]byte, 4*1024*1024)
+	rand.Read(skipped)
+
+	buffer := &bytes.Buffer{}
+	w := zip.NewWriter(buffer)
+	for _, m := range []struct {
+		name    string
+		method  uint16
+		content []byte
+	}{
+		{"a.txt", zip.Deflate, []byte("hello")},
+		{"dir/", zip.Store, nil},
+		{"dir/stored.bin", zip.Store, stored},
+		{"dir/deflated.txt", zip.Deflate, deflated},
+		{"skipped.bin", zip.Store, skipped},
+	} {
+		fw, _ := w.CreateHeader(&zip.FileHeader{Name: m.name, Method: m.method})
+		fw.Write(m.content)
+	}
+	w.Close()
+	src := buffer.Bytes()
+
+	var transferred int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &countResponseWriter{ResponseWriter: w, count: &transferred}
+		http.ServeContent(rw, r, "test.zip", time.Now().Add(-time.Hour), bytes.NewReader(src))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "gget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDefaultDownloader()
+	d.Directory = dir
+	request, _ := http.NewRequest("GET", server.URL+"/test.zip", nil)
+	files, err := d.Unzip(request, []string{"*.txt", "dir/stored.bin"}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expect 3 files, got %v", files)
+	}
+	for name, content := range map[string][]byte{"a.txt": []byte("hello"), "dir/stored.bin": stored, "dir/deflated.txt": deflated} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); !bytes.Equal(b, content) {
+			t.Errorf("Unexpected content of %s", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "skipped.bin")); err == nil {
+		t.Error("Expect skipped.bin not extracted")
+	}
+	if transferred := atomic.LoadInt64(&transferred); transferred > int64(len(src)-len(skipped)/2) {
+		t.Errorf("Read %d bytes of %d, expect unmatched member not downloaded", transferred, len(src))
+	}
+
+	// a failed extraction keeps the existing file
+	existing := filepath.Join(dir, "dir", "stored.bin")
+	ioutil.WriteFile(existing, []byte("existing"), 0644)
+	corrupt := append([]byte(nil), src...)
+	corrupt[bytes.Index(src, stored)+len(stored)/2] ^= 0xff
+	corruptServer := newETagServer(corrupt, func(r *http.Request) string { return `"v1"` })
+	defer corruptServer.Close()
+	request, _ = http.NewRequest("GET", corruptServer.URL+"/test.zip", nil)
+	if _, err = d.Unzip(request, []string{"dir/stored.bin"}, 4); !errors.Is(err, zip.ErrChecksum) {
+		t.Errorf("Expect %v, got %v", zip.ErrChecksum, err)
+	}
+	if b, _ := ioutil.ReadFile(existing); string(b) != "existing" {
+		t.Error("Existing file is changed by a failed extraction")
+	}
+	if _, err := os.Stat(existing + PartSuffix); err == nil {
+		t.Error("Expect part file removed")
+	}
+}
+
+func TestMemberPath(t *testing.T) {
+	for name, safe := range map[string]bool{
+		"a.txt":       true,
+		"dir/a.txt":   true,
+		"dir/":        true,
+		"../a.txt":    false,
+		"dir/../../a": false,
+		"/etc/passwd": false,
+		`..\a.txt`:    false,
+	} {
+		if _, err := memberPath("out", name); (err == nil) != safe || err != nil && !errors.Is(err, ErrUnsafeMember) {
+			t.Errorf("%q: unexpected error %v", name, err)
+		}
+	}
+
+	for _, c := range []struct {
+		name     string
+		patterns []string
+		match    bool
+	}{
+		{"dir/a.txt", nil, true},
+		{"dir/a.txt", []string{"*.txt"}, true},
+		{"dir/a.txt", []string{"dir/*"}, true},
+		{"dir/sub/a.txt", []string{"dir"}, true},
+		{"dir/a.txt", []string{"*.bin", "other/"}, false},
+	} {
+		if MatchMember(c.name, c.patterns) != c.match {
+			t.Errorf("%q %v: expect match %v", c.name, c.patterns, c.match)
+		}
+	}
+}
@@ -1,14 +1,13 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -81,40 +80,58 @@ func SetSuffixRange(request *http.Request, begin int64) {
 }
 
 // GetFileSize .
-func GetFileSize(filename string) int64 {
+func GetFileSize(filename string) (int64, error) {
 	fstat, err := os.Stat(filename)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			panic(err)
-		} else {
-			return 0
+			return 0, err
 		}
+		return 0, nil
 	}
-	return fstat.Size()
-}
-
-// ExtractFilenameFromURI .
-func ExtractFilenameFromURI(uri *url.URL) string {
-	paths := strings.Split(uri.Path, "/")
-	return paths[len(paths)-1]
+	return fstat.Size(), nil
 }
 
 // CopyWithReadTimeout .
 func CopyWithReadTimeout(dst io.Writer, src io.Reader, timeout time.Duration) (int64, error) {
-	writer := NewChanWriter(8)
-	go io.Copy(writer, src)
+	return CopyWithReadTimeoutContext(context.Background(), dst, src, timeout)
+}
+
+// CopyWithReadTimeoutContext .
+func CopyWithReadTimeoutContext(ctx context.Context, dst io.Writer, src io.Reader, timeout time.Duration) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := NewChanWriterContext(ctx, 8)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(writer, src)
+		done <- err
+	}()
 
 	total := int64(0)
+	write := func(b []byte) error {
+		n, err := dst.Write(b)
+		total += int64(n)
+		return err
+	}
 	for {
 		select {
 		case b := <-writer.Chan():
-			n, err := dst.Write(b)
-			total += int64(n)
-			if err != nil {
+			if err := write(b); err != nil {
 				return total, err
 			}
+		case err := <-done:
+			// io.Copy has returned, so every chunk is already buffered
+			for len(writer.Chan()) > 0 {
+				if err := write(<-writer.Chan()); err != nil {
+					return total, err
+				}
+			}
+			return total, err
 		case <-time.After(timeout):
 			return total, ErrReadTimeout
+		case <-ctx.Done():
+			return total, ctx.Err()
 		}
 	}
 }
@@ -0,0 +1,113 @@
+package downloader
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrRemoteChanged .
+var ErrRemoteChanged = errors.New("Remote File Changed")
+
+// Validator .
+type Validator struct {
+	ETag         string
+	LastModified string
+	Length       int64
+}
+
+// Remote .
+type Remote struct {
+	Validator
+	Range    bool
+	Filename string
+}
+
+// NewValidator .
+func NewValidator(response *http.Response, length int64) Validator {
+	return Validator{
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+		Length:       length,
+	}
+}
+
+// Empty .
+func (v Validator) Empty() bool {
+	return v.ETag == "" && v.LastModified == "" && v.Length <= 0
+}
+
+// Match .
+func (v Validator) Match(o Validator) bool {
+	if v.Length > 0 && o.Length > 0 && v.Length != o.Length {
+		return false
+	}
+	if v.ETag != "" && o.ETag != "" {
+		return v.ETag == o.ETag
+	}
+	if v.LastModified != "" && o.LastModified != "" {
+		return v.LastModified == o.LastModified
+	}
+	return true
+}
+
+// Equivalent reports whether two sources, e.g. mirrors, serve the same file.
+func (v Validator) Equivalent(o Validator) bool {
+	if v.Length != o.Length {
+		return false
+	}
+	if v.ETag != "" && v.ETag == o.ETag {
+		return true
+	}
+	if v.LastModified != "" && o.LastModified != "" {
+		return v.LastModified == o.LastModified
+	}
+	return v.ETag == "" || o.ETag == "" || v.ETag == o.ETag
+}
+
+// IfRange .
+func (v Validator) IfRange() string {
+	if v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") {
+		return v.ETag
+	}
+	return v.LastModified
+}
+
+// SetIfRange .
+func SetIfRange(request *http.Request, v Validator) {
+	if ifRange := v.IfRange(); ifRange != "" {
+		request.Header.Set("If-Range", ifRange)
+	}
+}
+
+// RemoteChanged .
+func RemoteChanged(request *http.Request, response *http.Response) bool {
+	ifRange := request.Header.Get("If-Range")
+	if ifRange == "" {
+		return false
+	}
+	if response.StatusCode == http.StatusOK {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		etag := response.Header.Get("ETag")
+		return etag != "" && etag != ifRange
+	}
+	lastModified := response.Header.Get("Last-Modified")
+	return lastModified != "" && lastModified != ifRange
+}
+
+// ContentRangeLength .
+func ContentRangeLength(response *http.Response) int64 {
+	contentRange := response.Header.Get("Content-Range")
+	index := strings.LastIndex(contentRange, "/")
+	if index < 0 {
+		return -1
+	}
+	length, err := strconv.ParseInt(strings.TrimSpace(contentRange[index+1:]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return length
+}
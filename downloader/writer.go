@@ -1,8 +1,10 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -17,14 +19,54 @@ type ProgressWriter struct {
 
 	previousWriteTime time.Time
 	byteSincePrevious int64
+	progress          *tracker
 }
 
 // ErrOutOfWriterLimitation .
 var ErrOutOfWriterLimitation = errors.New("Out of writer limitation")
 
+var (
+	// WriteBufferSize is the buffer of a connection, small reads are coalesced into one write of the file
+	WriteBufferSize = 256 * 1024
+	// WriteInterval bounds the time data waits in the buffer
+	WriteInterval = 100 * time.Millisecond
+
+	bufferPool sync.Pool
+)
+
+func getBuffer() *[]byte {
+	if b, ok := bufferPool.Get().(*[]byte); ok && len(*b) == WriteBufferSize {
+		return b
+	}
+	b := make([]byte, WriteBufferSize)
+	return &b
+}
+
+func putBuffer(b *[]byte) {
+	bufferPool.Put(b)
+}
+
+// readCoalesced reads until b is full, the reader fails, or interval passes.
+func readCoalesced(r io.Reader, b []byte, interval time.Duration) (int, error) {
+	begin := time.Now()
+	n := 0
+	for n < len(b) {
+		m, err := r.Read(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if time.Since(begin) >= interval {
+			break
+		}
+	}
+	return n, nil
+}
+
 // ChanWriter .
 type ChanWriter struct {
-	ch chan []byte
+	ch  chan []byte
+	ctx context.Context
 }
 
 // OffestWriter .
@@ -55,12 +97,15 @@ func (p *ProgressWriter) Write(b []byte) (int, error) {
 		return n, err
 	}
 
-	currentSize := SizeToReadable(float64(p.Current))
-	totalSize := SizeToReadable(float64(p.Total))
-	percentage := float64(p.Current) * 100.0 / float64(p.Total)
-	speed := float64(p.byteSincePrevious) / duration.Seconds()
-	logrus.Infof("%s: %s / %s, %.2f%%, %s/s\n", p.Title, currentSize, totalSize, percentage, SizeToReadable(speed))
-
+	if p.progress != nil {
+		p.progress.update(p.Current, 1, []SegmentProgress{{End: p.Total, Current: p.Current, JobId: 1, Active: true}})
+	} else {
+		currentSize := SizeToReadable(float64(p.Current))
+		totalSize := SizeToReadable(float64(p.Total))
+		percentage := float64(p.Current) * 100.0 / float64(p.Total)
+		speed := float64(p.byteSincePrevious) / duration.Seconds()
+		logrus.Infof("%s: %s / %s, %.2f%%, %s/s\n", p.Title, currentSize, totalSize, percentage, SizeToReadable(speed))
+	}
 	p.previousWriteTime = currentTime
 	p.byteSincePrevious = 0
 	return n, err
@@ -68,14 +113,23 @@ func (p *ProgressWriter) Write(b []byte) (int, error) {
 
 // NewChanWriter .
 func NewChanWriter(size int) *ChanWriter {
-	return &ChanWriter{ch: make(chan []byte, size)}
+	return NewChanWriterContext(context.Background(), size)
+}
+
+// NewChanWriterContext .
+func NewChanWriterContext(ctx context.Context, size int) *ChanWriter {
+	return &ChanWriter{ch: make(chan []byte, size), ctx: ctx}
 }
 
 func (w *ChanWriter) Write(b []byte) (int, error) {
 	cp := make([]byte, len(b))
 	copy(cp, b)
-	w.ch <- cp
-	return len(cp), nil
+	select {
+	case w.ch <- cp:
+		return len(cp), nil
+	case <-w.ctx.Done():
+		return 0, w.ctx.Err()
+	}
 }
 
 // Chan .
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/chentanyi/gget/downloader"
 	"github.com/sirupsen/logrus"
@@ -12,35 +18,79 @@ import (
 
 var (
 	uri              string
+	mirrors          []string
+	unzip            bool
+	patterns         []string
 	username         *string
 	password         *string
 	filename         *string
-	thread           *int
+	directory        *string
+	conflict         *string
+	inPlace          *bool
+	concurrent       *string
+	maxConcurrent    *int
+	thread           int
 	hashLen          *string
 	start            *string
 	downloadContinue *bool
+	checksum         *string
+	checksumURL      *string
+	checksumAuto     *bool
+	limitRate        *string
+	progressMode     *string
+	tries            *int
+	segmentRetries   *int
+	retryBudget      *int
+	retryWait        *time.Duration
+	retryMaxWait     *time.Duration
 	debug            *bool
 )
 
 // ParseArgs .
 func ParseArgs() {
 	cmd := &cobra.Command{
-		Use: "gget <url>",
+		Use:  "gget <url|metalink> [mirror-url...]",
+		Args: cobra.ArbitraryArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(args) < 1 {
 				cmd.Usage()
 				os.Exit(0)
 			}
 			uri = args[0]
+			mirrors = args[1:]
 		},
 	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "unzip <url> [member-pattern...]",
+		Short: "Extract members matching patterns (all without patterns) from a remote zip into --directory",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			unzip = true
+			uri = args[0]
+			patterns = args[1:]
+		},
+	})
 	downloadContinue = cmd.PersistentFlags().BoolP("continue", "c", true, "Continue Download")
 	username = cmd.PersistentFlags().StringP("username", "u", "", "Username")
 	password = cmd.PersistentFlags().StringP("password", "p", "", "Password")
-	filename = cmd.PersistentFlags().StringP("output", "o", "", "Output File")
-	thread = cmd.PersistentFlags().IntP("concurrent", "j", 8, "Concurrent Download Thread Number")
+	filename = cmd.PersistentFlags().StringP("output", "o", "", "Output File, - for stdout")
+	directory = cmd.PersistentFlags().StringP("directory", "P", "", "Output directory for files without --output")
+	conflict = cmd.PersistentFlags().String("conflict", "continue", "Policy for an existing file without .state: continue (as a partial download), overwrite, skip, rename (to name.1) or fail")
+	inPlace = cmd.PersistentFlags().Bool("in-place", false, "Download into the output file and keep its .state, rather than into .part renamed on completion")
+	concurrent = cmd.PersistentFlags().StringP("concurrent", "j", "8", "Concurrent Download Thread Number, or auto to tune it by throughput")
+	maxConcurrent = cmd.PersistentFlags().Int("max-concurrent", 16, "Max concurrent download thread number in auto mode")
 	hashLen = cmd.PersistentFlags().StringP("len", "l", "", "Max len to check downloaded file hash rather than do download, only compliable for github.com/chentanyi/fileserver")
 	start = cmd.PersistentFlags().StringP("start", "s", "0", "Start position to check hash")
+	checksum = cmd.PersistentFlags().String("checksum", "", "Verify downloaded file with checksum, format algo:hex, algo in md5, sha1, sha256, sha512")
+	checksumURL = cmd.PersistentFlags().String("checksum-url", "", "Verify downloaded file with checksum file from url")
+	limitRate = cmd.PersistentFlags().String("limit-rate", "", "Limit total download speed in bytes per second, e.g. 500K, 2M")
+	checksumAuto = cmd.PersistentFlags().Bool("checksum-auto", false, "Probe checksum files like file.sha256 and SHA256SUMS next to url")
+	progressMode = cmd.PersistentFlags().String("progress", "auto", "Progress output: auto, bar, log or json (one object per line on stdout)")
+	tries = cmd.PersistentFlags().Int("tries", 5, "Attempts of the whole download, 0 for unlimited")
+	segmentRetries = cmd.PersistentFlags().Int("segment-retries", 10, "Consecutive retries of a segment without progress, 0 for unlimited")
+	retryBudget = cmd.PersistentFlags().Int("retry-budget", 0, "Total retries of segments per attempt, 0 for unlimited")
+	retryWait = cmd.PersistentFlags().Duration("retry-wait", time.Second, "Initial backoff between retries, doubled every retry with jitter")
+	retryMaxWait = cmd.PersistentFlags().Duration("retry-max-wait", 30*time.Second, "Max backoff between retries")
 	debug = cmd.PersistentFlags().Bool("debug", false, "Show Debug Log")
 
 	err := cmd.Execute()
@@ -62,25 +112,191 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 
-	if match, err := regexp.MatchString("https?://", uri); !match || err != nil {
-		logrus.Errorf("Unsupport uri: %s", uri)
-		panic(err)
+	d := downloader.NewDefaultDownloader()
+	if *checksum != "" {
+		sum, err := downloader.ParseChecksum(*checksum)
+		if err != nil {
+			logrus.Errorf("Invalid checksum: %v", err)
+			os.Exit(1)
+		}
+		d.Checksum = sum
+	}
+	d.ChecksumURL = *checksumURL
+	d.ChecksumDiscovery = *checksumAuto
+	rate, err := downloader.SizeToInt(*limitRate)
+	if err != nil || rate < 0 {
+		logrus.Errorf("Invalid limit rate: %s", *limitRate)
+		os.Exit(1)
+	}
+	d.SetRateLimit(rate)
+	d.Directory = *directory
+	d.InPlace = *inPlace
+	if d.Conflict, err = downloader.ParseConflictPolicy(*conflict); err != nil {
+		logrus.Errorf("Invalid conflict: %v", err)
+		os.Exit(1)
+	}
+	d.Retry = downloader.DefaultRetryPolicy()
+	d.Retry.MaxAttempts = *tries
+	d.Retry.SegmentRetries = *segmentRetries
+	d.Retry.DownloadRetries = *retryBudget
+	d.Retry.InitialBackoff = *retryWait
+	d.Retry.MaxBackoff = *retryMaxWait
+	if *concurrent == "auto" {
+		d.Adaptive = true
+		thread = *maxConcurrent
+	} else if thread, err = strconv.Atoi(*concurrent); err != nil || thread < 1 {
+		logrus.Errorf("Invalid concurrent: %s", *concurrent)
+		os.Exit(1)
+	}
+	switch *progressMode {
+	case "auto", "bar":
+		if *progressMode == "bar" || !*debug && downloader.IsTerminal(os.Stderr) {
+			progress := downloader.NewTerminalProgress(os.Stderr)
+			logrus.SetOutput(progress)
+			d.Observer = progress
+		}
+	case "json":
+		if *filename == "-" {
+			d.Observer = downloader.NewJSONProgress(os.Stderr)
+		} else {
+			d.Observer = downloader.NewJSONProgress(os.Stdout)
+		}
+	case "log":
+	default:
+		logrus.Errorf("Invalid progress: %s", *progressMode)
+		os.Exit(1)
 	}
 
-	request, _ := http.NewRequest("GET", uri, nil)
-	request.SetBasicAuth(*username, *password)
-	logrus.Debugf("Request uri: %s", request.URL.String())
-	if *hashLen != "" {
-		if err := downloader.NewDefaultDownloader().FilterUnmatchedHash(request, *filename, *hashLen, *start); err != nil {
+	if unzip {
+		request, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			logrus.Errorf("Unsupport uri: %s", uri)
+			os.Exit(1)
+		}
+		request.SetBasicAuth(*username, *password)
+		run(func() error {
+			_, err := d.Unzip(request, patterns, thread)
+			return err
+		})
+		return
+	}
+
+	if isMetalink(uri) {
+		if *filename == "-" {
+			logrus.Errorf("Cannot stream metalink to stdout")
+			os.Exit(1)
+		}
+		downloadMetalink(d)
+		return
+	}
+
+	requests := make([]*http.Request, 0, len(mirrors)+1)
+	for _, u := range append([]string{uri}, mirrors...) {
+		if match, err := regexp.MatchString("https?://", u); !match || err != nil {
+			logrus.Errorf("Unsupport uri: %s", u)
+			panic(err)
+		}
+
+		request, _ := http.NewRequest("GET", u, nil)
+		request.SetBasicAuth(*username, *password)
+		logrus.Debugf("Request uri: %s", request.URL.String())
+		requests = append(requests, request)
+	}
+	request := requests[0]
+
+	if *filename == "-" {
+		run(func() error {
+			return stream(d, request)
+		})
+	} else if *hashLen != "" {
+		if err := d.FilterUnmatchedHash(request, *filename, *hashLen, *start); err != nil {
 			logrus.Errorf("Filter hash error: %v", err)
 		}
 	} else {
-		for {
-			if err := downloader.NewDefaultDownloader().DownloadFile(request, *thread, *filename); err != nil {
-				logrus.Errorf("Download error: %v, continue", err)
-			} else {
-				return
-			}
+		run(func() error {
+			return d.DownloadFileMirrors(requests, thread, *filename)
+		})
+	}
+}
+
+func stream(d *downloader.Downloader, request *http.Request) error {
+	if len(mirrors) > 0 {
+		logrus.Warnf("Mirrors are ignored when streaming to stdout")
+	}
+	reader, err := d.OpenStream(context.Background(), request, thread)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
+
+func run(download func() error) {
+	if err := download(); err != nil {
+		logrus.Errorf("Download error: %v", err)
+		os.Exit(1)
+	}
+}
+
+func isMetalink(uri string) bool {
+	if info, err := os.Stat(uri); err == nil && !info.IsDir() {
+		return true
+	}
+	if u, err := url.Parse(uri); err == nil {
+		return downloader.IsMetalink(u.Path)
+	}
+	return false
+}
+
+func downloadMetalink(d *downloader.Downloader) {
+	ctx := context.Background()
+	var metalink *downloader.Metalink
+	// credentials are sent to the host of the metalink url, or of the primary url of a local metalink
+	origin := ""
+	if b, err := ioutil.ReadFile(uri); err == nil {
+		metalink, err = downloader.ParseMetalink(b)
+		if err == nil {
+			// a local metalink has no url to resolve relative urls against
+			err = metalink.Resolve(nil)
+		}
+		if err != nil {
+			logrus.Errorf("Parse metalink %s error: %v", uri, err)
+			os.Exit(1)
+		}
+	} else {
+		request, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			logrus.Errorf("Unsupport uri: %s", uri)
+			os.Exit(1)
+		}
+		request.SetBasicAuth(*username, *password)
+		origin = uri
+		metalink, err = d.FetchMetalinkContext(ctx, request)
+		if err != nil {
+			logrus.Errorf("Fetch metalink %s error: %v", uri, err)
+			os.Exit(1)
+		}
+	}
+	if *filename != "" && len(metalink.Files) > 1 {
+		logrus.Errorf("Cannot use --output for metalink with %d files", len(metalink.Files))
+		os.Exit(1)
+	}
+
+	for _, file := range metalink.Files {
+		if file.Filename() == "" && *filename == "" {
+			logrus.Errorf("Invalid file name in metalink: %q", file.Name)
+			os.Exit(1)
+		}
+		primary := origin
+		if primary == "" {
+			primary = file.URLs[0].URL
 		}
+		template, _ := http.NewRequest("GET", primary, nil)
+		template.SetBasicAuth(*username, *password)
+		logrus.Infof("Download %s from %d urls", file.Name, len(file.URLs))
+		run(func() error {
+			return d.DownloadMetalinkFileContext(ctx, template, file, thread, *filename)
+		})
 	}
 }